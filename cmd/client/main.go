@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/caarlos0/env/v9"
 	"os"
+	"strconv"
 )
 
 func main() {
@@ -44,8 +45,182 @@ func main() {
 		} else {
 			fmt.Println("Entry was added successfully")
 		}
+	} else if args[0] == "delete" {
+		if len(args) < 2 {
+			fmt.Println("Invalid arguments. Key is required")
+			os.Exit(1)
+		}
+		deleteResponseError := client.Delete(args[1])
+		if deleteResponseError != nil {
+			fmt.Println(deleteResponseError.Error())
+		} else {
+			fmt.Println("Entry was deleted successfully")
+		}
+	} else if args[0] == "batch" {
+		batchKeys(client, args[1:])
+	} else if args[0] == "scan" {
+		if len(args) < 2 {
+			fmt.Println("Invalid arguments. Usage: scan <start> [end] [limit] or scan --prefix <prefix> [limit]")
+			os.Exit(1)
+		}
+		scanKeys(client, "", args[1:])
+	} else if args[0] == "snapshot" {
+		snapshotCommand(client, args[1:])
+	} else if args[0] == "compaction" {
+		if len(args) < 2 {
+			fmt.Println("Invalid arguments. Usage: compaction pause|resume|status|trigger [--wait]")
+			os.Exit(1)
+		}
+		action := args[1]
+		if action != "pause" && action != "resume" && action != "status" && action != "trigger" {
+			fmt.Println("Invalid arguments. Usage: compaction pause|resume|status|trigger [--wait]")
+			os.Exit(1)
+		}
+		wait := action == "trigger" && len(args) > 2 && args[2] == "--wait"
+		state, compactionResponseError := client.Compaction(action, wait)
+		if compactionResponseError != nil {
+			fmt.Println(compactionResponseError.Error())
+			os.Exit(1)
+		}
+		lastRun := state.LastRun
+		if lastRun == "" {
+			lastRun = "never"
+		}
+		fmt.Printf("paused=%t running=%t period=%ds runs=%d last_run=%s\n",
+			state.Paused, state.Running, state.PeriodSec, state.Runs, lastRun)
 	} else {
 		fmt.Println("Invalid arguments")
 		os.Exit(1)
 	}
 }
+
+const batchUsage = "Invalid arguments. Usage: batch set <key> <value> | delete <key> ..."
+
+// batchKeys applies the sets and deletes of args atomically.
+func batchKeys(client client2.Client, args []string) {
+	ops := make([]client2.BatchOp, 0)
+	for len(args) > 0 {
+		switch {
+		case args[0] == "set" && len(args) >= 3:
+			ops = append(ops, client2.BatchOp{Op: "set", Key: args[1], Value: args[2]})
+			args = args[3:]
+		case args[0] == "delete" && len(args) >= 2:
+			ops = append(ops, client2.BatchOp{Op: "delete", Key: args[1]})
+			args = args[2:]
+		default:
+			fmt.Println(batchUsage)
+			os.Exit(1)
+		}
+	}
+	if len(ops) == 0 {
+		fmt.Println(batchUsage)
+		os.Exit(1)
+	}
+	if batchResponseError := client.Batch(ops); batchResponseError != nil {
+		fmt.Println(batchResponseError.Error())
+		os.Exit(1)
+	}
+	fmt.Printf("Batch of %d writes was applied successfully\n", len(ops))
+}
+
+const snapshotUsage = "Invalid arguments. Usage: snapshot create | release <id> | get <id> <key> | scan <id> <start> [end] [limit] | scan <id> --prefix <prefix> [limit]"
+
+// snapshotCommand creates and releases snapshots and reads at them.
+func snapshotCommand(client client2.Client, args []string) {
+	if len(args) == 0 {
+		fmt.Println(snapshotUsage)
+		os.Exit(1)
+	}
+	switch {
+	case args[0] == "create":
+		snapshot, createResponseError := client.CreateSnapshot()
+		if createResponseError != nil {
+			fmt.Println(createResponseError.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("id=%s seq=%d lease=%ds expires_at=%s\n", snapshot.ID, snapshot.Seq, snapshot.LeaseSec, snapshot.ExpiresAt)
+	case args[0] == "release" && len(args) == 2:
+		if releaseResponseError := client.ReleaseSnapshot(args[1]); releaseResponseError != nil {
+			fmt.Println(releaseResponseError.Error())
+			os.Exit(1)
+		}
+		fmt.Println("Snapshot was released successfully")
+	case args[0] == "get" && len(args) == 3:
+		resp, getResponseError := client.SnapshotGet(args[1], args[2])
+		if getResponseError != nil {
+			fmt.Println(getResponseError.Error())
+		}
+		fmt.Println(resp)
+	case args[0] == "scan" && len(args) >= 3:
+		scanKeys(client, args[1], args[2:])
+	default:
+		fmt.Println(snapshotUsage)
+		os.Exit(1)
+	}
+}
+
+// scanKeys prints every page of a range or prefix scan, one entry per line.
+// With a snapshot id every page is read at the snapshot.
+func scanKeys(client client2.Client, snapshot string, args []string) {
+	var prefix, start, end string
+	limitArg := ""
+	if args[0] == "--prefix" {
+		if len(args) < 2 {
+			fmt.Println("Invalid arguments. Prefix is required")
+			os.Exit(1)
+		}
+		prefix = args[1]
+		if len(args) > 2 {
+			limitArg = args[2]
+		}
+	} else {
+		start = args[0]
+		if len(args) > 1 {
+			end = args[1]
+		}
+		if len(args) > 2 {
+			limitArg = args[2]
+		}
+	}
+	limit := 0
+	if limitArg != "" {
+		var parseLimitError error
+		limit, parseLimitError = strconv.Atoi(limitArg)
+		if parseLimitError != nil || limit <= 0 {
+			fmt.Println("Invalid arguments. Limit must be a positive number")
+			os.Exit(1)
+		}
+	}
+
+	printed := 0
+	for {
+		pageLimit := 0
+		if limit > 0 {
+			pageLimit = limit - printed
+		}
+		var page client2.ScanJson
+		var scanResponseError error
+		switch {
+		case prefix != "" && snapshot != "":
+			page, scanResponseError = client.SnapshotPrefixScan(snapshot, prefix, start, pageLimit)
+		case prefix != "":
+			page, scanResponseError = client.PrefixScan(prefix, start, pageLimit)
+		case snapshot != "":
+			page, scanResponseError = client.SnapshotScan(snapshot, start, end, pageLimit)
+		default:
+			page, scanResponseError = client.Scan(start, end, pageLimit)
+		}
+		if scanResponseError != nil {
+			fmt.Println(scanResponseError.Error())
+			os.Exit(1)
+		}
+		for _, item := range page.Items {
+			fmt.Printf("%s=%s\n", item.Key, item.Value)
+		}
+		printed += len(page.Items)
+		if page.Next == "" || (limit > 0 && printed >= limit) {
+			return
+		}
+		start = page.Next
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"PentHouseClub/internal/storage-service/config"
+	"PentHouseClub/internal/storage-service/storage"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+// lsm-verify checks a storage data directory offline and prints a JSON report.
+// It never modifies the directory, so it is safe to run on backups. The exit
+// status is 1 when the report holds errors.
+//
+// The directories default to SSTABLEDIR and JOURNALPATH as the storage service
+// reads them.
+func main() {
+	conf := config.New()
+	ssTableDir := flag.String("sstables", conf.SSTDir, "ssTables directory")
+	journalDir := flag.String("journal", conf.JPath, "WAL directory")
+	indent := flag.Bool("indent", false, "indent the report")
+	flag.Parse()
+
+	report := storage.Verify(*ssTableDir, *journalDir)
+	var data []byte
+	var err error
+	if *indent {
+		data, err = json.MarshalIndent(report, "", "  ")
+	} else {
+		data, err = json.Marshal(report)
+	}
+	if err != nil {
+		log.Fatalf("Error happened in JSON marshal. Err: %s", err)
+	}
+	fmt.Println(string(data))
+	if !report.OK {
+		os.Exit(1)
+	}
+}
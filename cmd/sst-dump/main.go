@@ -0,0 +1,121 @@
+package main
+
+import (
+	"PentHouseClub/internal/storage-service/storage"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+)
+
+// sst-dump prints the layout of an ssTable file: its sparse index, the offset
+// and the sizes of every segment and the key range. With -entries it also
+// prints the entries and their sequence numbers, all of them or those in
+// [-start, -end). Segments are decoded by the same code the storage service
+// reads them with.
+//
+// Tables written before the index moved into the table file need their index
+// journal, by default journal/<id>.bin beside the table.
+
+type entry struct {
+	Key     string `json:"key"`
+	Seq     uint64 `json:"seq,omitempty"`
+	Value   string `json:"value,omitempty"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+type dump struct {
+	Table   storage.TableInfo `json:"table"`
+	Entries []entry           `json:"entries,omitempty"`
+}
+
+func main() {
+	journalPath := flag.String("journal", "", "index journal of the table, journal/<id>.bin beside it by default")
+	withEntries := flag.Bool("entries", false, "dump the entries")
+	start := flag.String("start", "", "first key to dump")
+	end := flag.String("end", "", "key to stop the dump at, no bound when empty")
+	asJSON := flag.Bool("json", false, "print JSON")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] <ssTable path>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	path := flag.Arg(0)
+	if *journalPath == "" {
+		name := filepath.Base(path)
+		*journalPath = filepath.Join(filepath.Dir(path), "journal", strings.TrimSuffix(name, filepath.Ext(name))+".bin")
+	}
+
+	result := dump{}
+	var err error
+	result.Table, err = storage.InspectTable(path, *journalPath)
+	if err != nil {
+		log.Fatalf("Inspect ssTable error. Err: %s", err)
+	}
+	if *withEntries || *start != "" || *end != "" {
+		keyValues, err := storage.DumpTable(path, *journalPath, *start, *end)
+		if err != nil {
+			log.Fatalf("Dump ssTable entries error. Err: %s", err)
+		}
+		result.Entries = make([]entry, 0, len(keyValues))
+		for _, keyValue := range keyValues {
+			result.Entries = append(result.Entries, entry{Key: keyValue.Key, Seq: keyValue.Seq, Value: keyValue.Value, Deleted: keyValue.Deleted})
+		}
+	}
+
+	if *asJSON {
+		data, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			log.Fatalf("Error happened in JSON marshal. Err: %s", err)
+		}
+		fmt.Println(string(data))
+		return
+	}
+	printText(result)
+}
+
+func printText(result dump) {
+	table := result.Table
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "id\t%s\n", table.ID)
+	fmt.Fprintf(w, "path\t%s\n", table.Path)
+	if table.JournalPath != "" {
+		fmt.Fprintf(w, "journal\t%s\n", table.JournalPath)
+	}
+	fmt.Fprintf(w, "format\t%s\n", table.Format)
+	fmt.Fprintf(w, "codec\t%s\n", table.Codec)
+	fmt.Fprintf(w, "file size\t%d\n", table.FileSize)
+	fmt.Fprintf(w, "compressed size\t%d\n", table.CompressedSize)
+	fmt.Fprintf(w, "uncompressed size\t%d\n", table.UncompressedSize)
+	fmt.Fprintf(w, "entries\t%d\n", table.Entries)
+	fmt.Fprintf(w, "tombstones\t%d\n", table.Tombstones)
+	fmt.Fprintf(w, "key range\t[%q, %q]\n", table.FirstKey, table.LastKey)
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "#\tfirst key\tlast key\toffset\tcompressed\tuncompressed\tentries\tcodec\tchecksum")
+	for i, segment := range table.Segments {
+		fmt.Fprintf(w, "%d\t%q\t%q\t%d\t%d\t%d\t%d\t%s\t%08x\n", i, segment.FirstKey, segment.LastKey, segment.Offset, segment.CompressedSize,
+			segment.UncompressedSize, segment.Entries, segment.Codec, segment.Checksum)
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatalf("Write dump error. Err: %s", err)
+	}
+	if result.Entries == nil {
+		return
+	}
+	fmt.Println()
+	for _, keyValue := range result.Entries {
+		if keyValue.Deleted {
+			fmt.Printf("%q\t%d\t<deleted>\n", keyValue.Key, keyValue.Seq)
+			continue
+		}
+		fmt.Printf("%q\t%d\t%q\n", keyValue.Key, keyValue.Seq, keyValue.Value)
+	}
+}
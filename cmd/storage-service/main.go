@@ -21,9 +21,29 @@ func main() {
 	viper.SetDefault("listen", ":8080")
 	setUrl := fmt.Sprintf("/keys/set")
 	getUrl := fmt.Sprintf("/keys/get")
+	deleteUrl := fmt.Sprintf("/keys/delete")
+	batchUrl := fmt.Sprintf("/keys/batch")
+	scanUrl := fmt.Sprintf("/keys/scan")
+	statsUrl := fmt.Sprintf("/stats")
+	pauseCompactionUrl := fmt.Sprintf("/admin/compaction/pause")
+	resumeCompactionUrl := fmt.Sprintf("/admin/compaction/resume")
+	triggerCompactionUrl := fmt.Sprintf("/admin/compaction/trigger")
+	compactionStatusUrl := fmt.Sprintf("/admin/compaction/status")
+	createSnapshotUrl := fmt.Sprintf("/snapshots/create")
+	releaseSnapshotUrl := fmt.Sprintf("/snapshots/release")
 
 	http.HandleFunc(getUrl, storageService.Get)
 	http.HandleFunc(setUrl, storageService.Set)
+	http.HandleFunc(deleteUrl, storageService.Delete)
+	http.HandleFunc(batchUrl, storageService.Batch)
+	http.HandleFunc(scanUrl, storageService.Scan)
+	http.HandleFunc(statsUrl, storageService.Stats)
+	http.HandleFunc(pauseCompactionUrl, storageService.PauseCompaction)
+	http.HandleFunc(resumeCompactionUrl, storageService.ResumeCompaction)
+	http.HandleFunc(triggerCompactionUrl, storageService.TriggerCompaction)
+	http.HandleFunc(compactionStatusUrl, storageService.CompactionStatus)
+	http.HandleFunc(createSnapshotUrl, storageService.CreateSnapshot)
+	http.HandleFunc(releaseSnapshotUrl, storageService.ReleaseSnapshot)
 
 	//line := scanner.Text()
 	//lineElements := strings.Split(line, "=")
@@ -1,17 +1,29 @@
 package client
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 )
 
 type Client interface {
 	Get(key string) (string, error)
 	Set(key string, value string) error
+	Delete(key string) error
+	Batch(ops []BatchOp) error
+	Scan(start string, end string, limit int) (ScanJson, error)
+	PrefixScan(prefix string, start string, limit int) (ScanJson, error)
+	Compaction(action string, wait bool) (CompactionJson, error)
+	CreateSnapshot() (SnapshotJson, error)
+	ReleaseSnapshot(id string) error
+	SnapshotGet(id string, key string) (string, error)
+	SnapshotScan(id string, start string, end string, limit int) (ScanJson, error)
+	SnapshotPrefixScan(id string, prefix string, start string, limit int) (ScanJson, error)
 }
 
 type ClientImpl struct {
@@ -24,7 +36,65 @@ type RespJson struct {
 	Error   string `json:"error"`
 }
 
+type StatusJson struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+}
+
+// BatchOp is one write of a batch. Op is "set" or "delete".
+type BatchOp struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+type ScanItem struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// ScanJson is one page of a scan. Next is the start key of the following page
+// and is empty on the last page.
+type ScanJson struct {
+	Items   []ScanItem `json:"items"`
+	Next    string     `json:"next"`
+	Message string     `json:"message"`
+	Error   string     `json:"error"`
+}
+
+// CompactionJson is the compaction scheduler state returned by the admin
+// endpoints.
+type CompactionJson struct {
+	Paused    bool   `json:"paused"`
+	Running   bool   `json:"running"`
+	PeriodSec int    `json:"period_sec"`
+	Runs      int64  `json:"runs"`
+	LastRun   string `json:"last_run"`
+	Message   string `json:"message"`
+	Error     string `json:"error"`
+}
+
+// SnapshotJson is a snapshot leased by the storage service. The lease runs
+// for LeaseSec from the last request made at the snapshot.
+type SnapshotJson struct {
+	ID        string `json:"id"`
+	Seq       uint64 `json:"seq"`
+	LeaseSec  int    `json:"lease_sec"`
+	ExpiresAt string `json:"expires_at"`
+	Message   string `json:"message"`
+	Error     string `json:"error"`
+}
+
 func (client ClientImpl) Get(key string) (string, error) {
+	return client.get(map[string]string{"key": key})
+}
+
+// SnapshotGet returns the value of key as of the snapshot id.
+func (client ClientImpl) SnapshotGet(id string, key string) (string, error) {
+	return client.get(map[string]string{"key": key, "snapshot": id})
+}
+
+func (client ClientImpl) get(params map[string]string) (string, error) {
 	url := fmt.Sprintf("%s/keys/get", client.BaseUrl)
 	req, createRequestError := http.NewRequest(http.MethodGet, url, nil)
 	if createRequestError != nil {
@@ -32,7 +102,9 @@ func (client ClientImpl) Get(key string) (string, error) {
 		os.Exit(1)
 	}
 	q := req.URL.Query()
-	q.Add("key", key)
+	for name, value := range params {
+		q.Add(name, value)
+	}
 	req.URL.RawQuery = q.Encode()
 
 	clientR := &http.Client{}
@@ -89,3 +161,241 @@ func (client ClientImpl) Set(key, value string) error {
 	}
 	return nil
 }
+
+func (client ClientImpl) Delete(key string) error {
+	url := fmt.Sprintf("%s/keys/delete", client.BaseUrl)
+	req, createRequestError := http.NewRequest(http.MethodDelete, url, nil)
+	if createRequestError != nil {
+		log.Print(createRequestError)
+		os.Exit(1)
+	}
+
+	q := req.URL.Query()
+	q.Add("key", key)
+	req.URL.RawQuery = q.Encode()
+
+	clientR := &http.Client{}
+	resp, doRequestErr := clientR.Do(req)
+	if doRequestErr != nil {
+		return doRequestErr
+	}
+
+	defer func() {
+		closeResponseError := resp.Body.Close()
+		if closeResponseError != nil {
+			log.Fatalf("Close response body error. Err: %s", closeResponseError)
+		}
+	}()
+
+	var statusJson StatusJson
+	if getResponseErr := json.NewDecoder(resp.Body).Decode(&statusJson); getResponseErr != nil {
+		return getResponseErr
+	}
+	if statusJson.Status != "OK" {
+		return errors.New(statusJson.Error)
+	}
+	return nil
+}
+
+// Batch applies the ops atomically: the storage service stores all of them or
+// none.
+func (client ClientImpl) Batch(ops []BatchOp) error {
+	url := fmt.Sprintf("%s/keys/batch", client.BaseUrl)
+	body, marshalErr := json.Marshal(map[string][]BatchOp{"ops": ops})
+	if marshalErr != nil {
+		return marshalErr
+	}
+	req, createRequestError := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if createRequestError != nil {
+		return createRequestError
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	clientR := &http.Client{}
+	resp, doRequestErr := clientR.Do(req)
+	if doRequestErr != nil {
+		return doRequestErr
+	}
+
+	defer func() {
+		closeResponseError := resp.Body.Close()
+		if closeResponseError != nil {
+			log.Fatalf("Close response body error. Err: %s", closeResponseError)
+		}
+	}()
+
+	var statusJson StatusJson
+	if getResponseErr := json.NewDecoder(resp.Body).Decode(&statusJson); getResponseErr != nil {
+		return getResponseErr
+	}
+	if statusJson.Status != "OK" {
+		return errors.New(statusJson.Error)
+	}
+	return nil
+}
+
+func (client ClientImpl) Scan(start string, end string, limit int) (ScanJson, error) {
+	return client.scan(map[string]string{"start": start, "end": end}, limit)
+}
+
+func (client ClientImpl) PrefixScan(prefix string, start string, limit int) (ScanJson, error) {
+	return client.scan(map[string]string{"prefix": prefix, "start": start}, limit)
+}
+
+// SnapshotScan is Scan as of the snapshot id. Every page of it reads the same
+// view of the storage.
+func (client ClientImpl) SnapshotScan(id string, start string, end string, limit int) (ScanJson, error) {
+	return client.scan(map[string]string{"start": start, "end": end, "snapshot": id}, limit)
+}
+
+func (client ClientImpl) SnapshotPrefixScan(id string, prefix string, start string, limit int) (ScanJson, error) {
+	return client.scan(map[string]string{"prefix": prefix, "start": start, "snapshot": id}, limit)
+}
+
+func (client ClientImpl) scan(params map[string]string, limit int) (ScanJson, error) {
+	var scanJson ScanJson
+	url := fmt.Sprintf("%s/keys/scan", client.BaseUrl)
+	req, createRequestError := http.NewRequest(http.MethodGet, url, nil)
+	if createRequestError != nil {
+		return scanJson, createRequestError
+	}
+
+	q := req.URL.Query()
+	for name, value := range params {
+		if value != "" {
+			q.Add(name, value)
+		}
+	}
+	if limit > 0 {
+		q.Add("limit", strconv.Itoa(limit))
+	}
+	req.URL.RawQuery = q.Encode()
+
+	clientR := &http.Client{}
+	resp, doRequestErr := clientR.Do(req)
+	if doRequestErr != nil {
+		return scanJson, doRequestErr
+	}
+
+	defer func() {
+		closeResponseError := resp.Body.Close()
+		if closeResponseError != nil {
+			log.Fatalf("Close response body error. Err: %s", closeResponseError)
+		}
+	}()
+
+	if getResponseErr := json.NewDecoder(resp.Body).Decode(&scanJson); getResponseErr != nil {
+		return scanJson, getResponseErr
+	}
+	if scanJson.Message != "OK" {
+		return scanJson, errors.New(scanJson.Error)
+	}
+	return scanJson, nil
+}
+
+// Compaction calls the admin compaction endpoint for action, one of pause,
+// resume, trigger and status. With wait set a trigger returns once the run is
+// over.
+func (client ClientImpl) Compaction(action string, wait bool) (CompactionJson, error) {
+	var compactionJson CompactionJson
+	url := fmt.Sprintf("%s/admin/compaction/%s", client.BaseUrl, action)
+	req, createRequestError := http.NewRequest(http.MethodPost, url, nil)
+	if createRequestError != nil {
+		return compactionJson, createRequestError
+	}
+	if wait {
+		q := req.URL.Query()
+		q.Add("wait", "true")
+		req.URL.RawQuery = q.Encode()
+	}
+
+	clientR := &http.Client{}
+	resp, doRequestErr := clientR.Do(req)
+	if doRequestErr != nil {
+		return compactionJson, doRequestErr
+	}
+
+	defer func() {
+		closeResponseError := resp.Body.Close()
+		if closeResponseError != nil {
+			log.Fatalf("Close response body error. Err: %s", closeResponseError)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return compactionJson, errors.New(resp.Status)
+	}
+	if getResponseErr := json.NewDecoder(resp.Body).Decode(&compactionJson); getResponseErr != nil {
+		return compactionJson, getResponseErr
+	}
+	if compactionJson.Message != "OK" {
+		return compactionJson, errors.New(compactionJson.Error)
+	}
+	return compactionJson, nil
+}
+
+// CreateSnapshot takes a snapshot of the storage. It is released by
+// ReleaseSnapshot or once its lease runs out.
+func (client ClientImpl) CreateSnapshot() (SnapshotJson, error) {
+	var snapshotJson SnapshotJson
+	url := fmt.Sprintf("%s/snapshots/create", client.BaseUrl)
+	req, createRequestError := http.NewRequest(http.MethodPost, url, nil)
+	if createRequestError != nil {
+		return snapshotJson, createRequestError
+	}
+
+	clientR := &http.Client{}
+	resp, doRequestErr := clientR.Do(req)
+	if doRequestErr != nil {
+		return snapshotJson, doRequestErr
+	}
+
+	defer func() {
+		closeResponseError := resp.Body.Close()
+		if closeResponseError != nil {
+			log.Fatalf("Close response body error. Err: %s", closeResponseError)
+		}
+	}()
+
+	if getResponseErr := json.NewDecoder(resp.Body).Decode(&snapshotJson); getResponseErr != nil {
+		return snapshotJson, getResponseErr
+	}
+	if snapshotJson.Message != "OK" {
+		return snapshotJson, errors.New(snapshotJson.Error)
+	}
+	return snapshotJson, nil
+}
+
+func (client ClientImpl) ReleaseSnapshot(id string) error {
+	url := fmt.Sprintf("%s/snapshots/release", client.BaseUrl)
+	req, createRequestError := http.NewRequest(http.MethodPost, url, nil)
+	if createRequestError != nil {
+		return createRequestError
+	}
+
+	q := req.URL.Query()
+	q.Add("id", id)
+	req.URL.RawQuery = q.Encode()
+
+	clientR := &http.Client{}
+	resp, doRequestErr := clientR.Do(req)
+	if doRequestErr != nil {
+		return doRequestErr
+	}
+
+	defer func() {
+		closeResponseError := resp.Body.Close()
+		if closeResponseError != nil {
+			log.Fatalf("Close response body error. Err: %s", closeResponseError)
+		}
+	}()
+
+	var statusJson StatusJson
+	if getResponseErr := json.NewDecoder(resp.Body).Decode(&statusJson); getResponseErr != nil {
+		return getResponseErr
+	}
+	if statusJson.Status != "OK" {
+		return errors.New(statusJson.Error)
+	}
+	return nil
+}
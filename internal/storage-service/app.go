@@ -4,13 +4,13 @@ import (
 	"PentHouseClub/internal/storage-service/config"
 	"PentHouseClub/internal/storage-service/service"
 	"PentHouseClub/internal/storage-service/storage"
-	"bufio"
-	"gopkg.in/OlexiyKhokhlov/avltree.v2"
+	"github.com/google/uuid"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
-	"unsafe"
+	"time"
 )
 
 type App struct {
@@ -18,7 +18,7 @@ type App struct {
 	service.StorageService
 }
 
-func (app App) Init(configInfo config.LSMconfig, memTable storage.MemTable, journalPath string, ssTables *[]storage.SsTable) service.StorageService {
+func (app App) Init(configInfo config.LSMconfig, memTable storage.MemTable, journalPath string, wal *storage.WAL, manifest *storage.Manifest, ssTables *[]storage.SsTable, blockCache *storage.BlockCache) service.StorageService {
 	var storageService service.StorageService
 	dirPath := filepath.Join(GetWorkDirAbsPath(), configInfo.SSTDir)
 	err := os.MkdirAll(dirPath, 0777)
@@ -29,82 +29,235 @@ func (app App) Init(configInfo config.LSMconfig, memTable storage.MemTable, jour
 	if err != nil {
 		log.Printf("error occuring while creating journal dir. Err: %s", err)
 	}
-	merger := storage.MergerImpl{
-		MemNewFileLimit:      memTable.MaxSize,
-		StorageSstDirPath:    dirPath,
-		SsTableSegmentLength: configInfo.SSTsegLen,
-	}
+	compression := app.NewCompression(configInfo)
+	merger := app.NewMerger(configInfo, memTable.MaxSize(), dirPath, blockCache, compression)
 	storage := storage.StorageImpl{
-		MemTable:             memTable,
-		SsTableSegmentLength: configInfo.SSTsegLen,
-		SsTableDir:           dirPath,
-		SsTables:             ssTables,
-		JournalPath:          journalPath,
-		Merger:               merger,
-		MergePeriodSec:       configInfo.GCperiodSec,
+		MemTable:              memTable,
+		SsTableSegmentLength:  configInfo.SSTsegLen,
+		SsTableDir:            dirPath,
+		SsTables:              ssTables,
+		Wal:                   wal,
+		Manifest:              manifest,
+		Merger:                merger,
+		BloomBitsPerKey:       configInfo.BloomBitsPerKey,
+		BlockCache:            blockCache,
+		Compression:           compression,
+		MaxImmutableMemTables: configInfo.MaxImmutableMemTables,
+		Scheduler:             storage.NewCompactionScheduler(time.Duration(configInfo.GCperiodSec) * time.Second),
 	}
 	go storage.GC()
-	storageService = service.StorageServiceImpl{Storage: &storage}
+	leaseSec := configInfo.SnapshotLeaseSec
+	if leaseSec <= 0 {
+		log.Printf("Snapshot lease must be positive, using 60 seconds")
+		leaseSec = 60
+	}
+	storageService = service.StorageServiceImpl{
+		Storage:   &storage,
+		Snapshots: service.NewSnapshotLeases(time.Duration(leaseSec) * time.Second),
+	}
 
 	return storageService
 }
 
+// NewMerger returns the compaction strategy chosen in the config.
+func (app App) NewMerger(configInfo config.LSMconfig, newFileLimit uintptr, dirPath string, blockCache *storage.BlockCache, compression storage.Compression) storage.Merger {
+	switch configInfo.CompactionStrategy {
+	case "leveled":
+		maxLevels := configInfo.MaxLevels
+		if maxLevels < 2 {
+			maxLevels = 2
+		}
+		merger := &storage.LeveledMerger{
+			L0CompactionTrigger: configInfo.L0CompactionTrigger,
+			BaseLevelSize:       configInfo.LevelBaseSize,
+			LevelSizeMultiplier: configInfo.LevelSizeMultiplier,
+			MaxLevels:           maxLevels,
+		}
+		merger.MemNewFileLimit = newFileLimit
+		merger.StorageSstDirPath = dirPath
+		merger.SsTableSegmentLength = configInfo.SSTsegLen
+		merger.BloomBitsPerKey = configInfo.BloomBitsPerKey
+		merger.BlockCache = blockCache
+		merger.Compression = compression
+		return merger
+	case "tiered":
+		minThreshold := configInfo.TierMinThreshold
+		if minThreshold < 2 {
+			minThreshold = 2
+		}
+		merger := &storage.SizeTieredMerger{
+			MinThreshold: minThreshold,
+			MaxThreshold: configInfo.TierMaxThreshold,
+			BucketLow:    0.5,
+			BucketHigh:   1.5,
+			MinTableSize: configInfo.TierMinTableSize,
+		}
+		merger.MemNewFileLimit = newFileLimit
+		merger.StorageSstDirPath = dirPath
+		merger.SsTableSegmentLength = configInfo.SSTsegLen
+		merger.BloomBitsPerKey = configInfo.BloomBitsPerKey
+		merger.BlockCache = blockCache
+		merger.Compression = compression
+		return merger
+	case "merge":
+	default:
+		log.Printf("Unknown compaction strategy %s, merging every ssTable", configInfo.CompactionStrategy)
+	}
+	return &storage.MergerImpl{
+		MemNewFileLimit:      newFileLimit,
+		StorageSstDirPath:    dirPath,
+		SsTableSegmentLength: configInfo.SSTsegLen,
+		BloomBitsPerKey:      configInfo.BloomBitsPerKey,
+		BlockCache:           blockCache,
+		Compression:          compression,
+	}
+}
+
+// NewCompression returns the codecs of new ssTables chosen in the config. Only
+// leveled compaction writes tables past level 0, so the other strategies
+// ignore the level overrides.
+func (app App) NewCompression(configInfo config.LSMconfig) storage.Compression {
+	levelCompression := configInfo.LevelCompression
+	if levelCompression != "" && configInfo.CompactionStrategy != "leveled" {
+		log.Printf("Level compression needs leveled compaction, ignoring %q", levelCompression)
+		levelCompression = ""
+	}
+	compression, err := storage.ParseCompression(configInfo.Compression, levelCompression)
+	if err != nil {
+		log.Printf("Bad compression config, using gzip. Err: %s", err)
+		return storage.Compression{}
+	}
+	return compression
+}
+
+// NewSyncPolicy returns the journal sync policy chosen in the config.
+func (app App) NewSyncPolicy(configInfo config.LSMconfig) storage.SyncPolicy {
+	policy := storage.SyncPolicy{
+		Mode:     storage.SyncMode(configInfo.WalSyncMode),
+		Interval: time.Duration(configInfo.WalSyncIntervalMs) * time.Millisecond,
+		Bytes:    configInfo.WalSyncBytes,
+	}
+	switch policy.Mode {
+	case storage.SyncNone, storage.SyncAlways:
+	case storage.SyncInterval:
+		if policy.Interval <= 0 {
+			log.Printf("Journal sync interval must be positive, syncing every write")
+			policy.Mode = storage.SyncAlways
+		}
+	case storage.SyncBytes:
+		if policy.Bytes <= 0 {
+			log.Printf("Journal sync bytes must be positive, syncing every write")
+			policy.Mode = storage.SyncAlways
+		}
+	default:
+		log.Printf("Unknown journal sync mode %s, syncing every write", configInfo.WalSyncMode)
+		policy.Mode = storage.SyncAlways
+	}
+	return policy
+}
+
 func (app App) Start(configInfo config.LSMconfig) service.StorageService {
-	var memTable = storage.MemTable{AvlTree: avltree.NewAVLTreeOrderedKey[string, string](),
-		MaxSize:  configInfo.MtSize,
-		CurrSize: new(uintptr)}
+	ssTablesDir := filepath.Join(GetWorkDirAbsPath(), configInfo.SSTDir)
+	version, manifest, err := app.RecoverVersion(ssTablesDir)
+	if err != nil {
+		log.Fatalf("Recover ssTables error. Err: %s", err)
+	}
+
+	memTable := app.NewMemTable(configInfo)
 	journalPath := filepath.Join(GetWorkDirAbsPath(), configInfo.JPath)
-	journalName, _ := os.ReadDir(journalPath)
-	if len(journalName) != 0 {
-		log.Printf("Restoring AVL tree")
-		memTable.AvlTree, *memTable.CurrSize = app.RestoreAvlTree(filepath.Join(journalPath, journalName[0].Name()))
+	wal, walRecords, err := storage.OpenWAL(journalPath, app.NewSyncPolicy(configInfo), configInfo.WalSegmentSize)
+	if err != nil {
+		log.Fatalf("Open journal error. Err: %s", err)
 	}
-	os.RemoveAll(journalPath)
-	ssTablesDir := filepath.Join(GetWorkDirAbsPath(), configInfo.SSTDir)
-	ssTablesJournalPath := filepath.Join(ssTablesDir, "journal")
-	ssTablesjournalName, _ := os.ReadDir(ssTablesJournalPath)
-	var ssTables = new([]storage.SsTable)
-	if len(ssTablesjournalName) != 0 {
-		log.Printf("Restoring ssTables")
-		for _, journal := range ssTablesjournalName {
-			journalPath := filepath.Join(ssTablesJournalPath, journal.Name())
-			ssTableName := filepath.Join(ssTablesDir, journal.Name())
-			*ssTables = append(*ssTables, storage.Restore(ssTableName, journalPath, journal.Name()))
+	// Segments whose removal was cut short by a crash may hold flushed writes.
+	wal.MarkFlushed(version.FlushedSeq)
+	if len(walRecords) != 0 {
+		log.Printf("Restoring MemTable")
+		app.RestoreMemTable(memTable, walRecords, version.FlushedSeq)
+	}
+	blockCache := storage.NewBlockCache(configInfo.BlockCacheSize)
+	ssTables := storage.OpenTables(ssTablesDir, version, blockCache)
+	return app.Init(configInfo, memTable, journalPath, wal, manifest, &ssTables, blockCache)
+}
+
+// RecoverVersion reads the live ssTables of dir from its manifest and starts a
+// new manifest holding them. Files of no live table are removed only once the
+// manifest has been read without errors, a corrupt manifest removes nothing.
+func (app App) RecoverVersion(dir string) (storage.Version, *storage.Manifest, error) {
+	version, found, err := storage.RecoverManifest(dir)
+	if err != nil {
+		return version, nil, err
+	}
+	if !found {
+		log.Printf("No manifest found, taking every ssTable in %s as live", dir)
+		version = app.ListSsTables(dir)
+	}
+	manifest, err := storage.CreateManifest(dir, version)
+	if err != nil {
+		return version, nil, err
+	}
+	storage.RemoveOrphans(dir, version)
+	return version, manifest, nil
+}
+
+// ListSsTables returns a version holding every ssTable of dir from the oldest
+// to the newest file. It recovers data written before the manifest existed.
+func (app App) ListSsTables(dir string) storage.Version {
+	entries, _ := os.ReadDir(dir)
+	type tableFile struct {
+		id      uuid.UUID
+		modTime time.Time
+	}
+	files := make([]tableFile, 0)
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".gz" {
+			continue
+		}
+		id, err := uuid.Parse(strings.TrimSuffix(entry.Name(), ".gz"))
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			log.Printf("Stat ssTable %s error. Err: %s", entry.Name(), err)
+			continue
 		}
+		files = append(files, tableFile{id: id, modTime: info.ModTime()})
 	}
-	return app.Init(configInfo, memTable, journalPath, ssTables)
+	sort.SliceStable(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	var version storage.Version
+	for _, file := range files {
+		version.Tables = append(version.Tables, storage.TableMeta{ID: file.id})
+	}
+	return version
 }
 
-func (app App) RestoreAvlTree(journalPath string) (*avltree.AVLTree[string, string], uintptr) {
-	f, err := os.Open(journalPath)
+// NewMemTable returns an empty MemTable of the configured kind.
+func (app App) NewMemTable(configInfo config.LSMconfig) storage.MemTable {
+	memTable, err := storage.NewMemTable(configInfo.MemTableKind, configInfo.MtSize)
 	if err != nil {
-		log.Printf("Open journal error. Err: %s", err)
-		return avltree.NewAVLTreeOrderedKey[string, string](), uintptr(0)
+		log.Printf("Unknown MemTable kind %s, using skiplist", configInfo.MemTableKind)
+		memTable = storage.NewSkipListMemTable(configInfo.MtSize)
 	}
-	defer func() {
-		if err = f.Close(); err != nil {
-			log.Printf("Close journal error. Err: %s", err)
+	return memTable
+}
+
+// RestoreMemTable applies the replayed journal records after flushedSeq in
+// sequence order.
+func (app App) RestoreMemTable(memTable storage.MemTable, walRecords []storage.WalRecord, flushedSeq uint64) {
+	// The replayed MemTable may exceed its limit, the next write flushes it.
+	for _, walRecord := range walRecords {
+		if walRecord.Seq <= flushedSeq {
+			continue
 		}
-	}()
-	var avlTree = avltree.NewAVLTreeOrderedKey[string, string]()
-	sc := bufio.NewScanner(f)
-	var size = *new(uintptr)
-	for sc.Scan() {
-		var logInfo = strings.Split(strings.Split(sc.Text(), ".")[0], ":")
-		var key = logInfo[1][1:]
-		var value = logInfo[2]
-		var pair = avlTree.Find(key)
-		if pair != nil {
-			if *pair != value {
-				avlTree.Erase(key)
-				avlTree.Insert(key, value)
+		for _, keyValue := range walRecord.Entries {
+			if keyValue.Deleted {
+				memTable.Delete(keyValue.Key, walRecord.Seq)
+			} else {
+				memTable.Add(keyValue.Key, keyValue.Value, walRecord.Seq)
 			}
-		} else {
-			size += unsafe.Sizeof(key) + unsafe.Sizeof(value) + 8
-			avlTree.Insert(key, value)
 		}
 	}
-	return avlTree, size
 }
 
 func GetWorkDirAbsPath() string {
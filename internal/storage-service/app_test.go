@@ -0,0 +1,110 @@
+package storage_service
+
+import (
+	"PentHouseClub/internal/storage-service/config"
+	"PentHouseClub/internal/storage-service/storage"
+	"github.com/google/uuid"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// RecoverVersion removes the files of tables the manifest does not hold, so it
+// must not remove anything when the manifest cannot be read.
+func TestRecoverVersionKeepsTablesOfCorruptManifest(t *testing.T) {
+	tests := []struct {
+		name string
+		// damage changes the manifest, edits are the offsets of its three
+		// logged edits.
+		damage func(data []byte, edits []int64) []byte
+		// wantErr tells whether recovery fails, kept whether the tables of
+		// every edit are still on disk.
+		wantErr bool
+		kept    []bool
+	}{
+		{"intact", func(data []byte, edits []int64) []byte { return data }, false, []bool{true, true, true}},
+		{"torn last edit", func(data []byte, edits []int64) []byte { return data[:len(data)-2] }, false, []bool{true, true, false}},
+		{"middle edit bit flipped", func(data []byte, edits []int64) []byte { data[edits[1]+10] ^= 0x01; return data }, true, []bool{true, true, true}},
+		{"first edit checksum flipped", func(data []byte, edits []int64) []byte { data[edits[0]+4] ^= 0x01; return data }, true, []bool{true, true, true}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			initial := storage.TableMeta{ID: uuid.New()}
+			manifest, err := storage.CreateManifest(dir, storage.Version{Tables: []storage.TableMeta{initial}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			current, err := os.ReadFile(filepath.Join(dir, "CURRENT"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			manifestPath := filepath.Join(dir, strings.TrimSpace(string(current)))
+			ids := []uuid.UUID{initial.ID}
+			edits := make([]int64, 0, 3)
+			for i := 0; i < 3; i++ {
+				info, err := os.Stat(manifestPath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				edits = append(edits, info.Size())
+				ids = append(ids, uuid.New())
+				if err = manifest.LogEdit(storage.VersionEdit{Added: []storage.TableMeta{{ID: ids[i+1]}}, FlushedSeq: uint64(i + 1)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			manifest.Close()
+			for _, id := range ids {
+				for _, ext := range []string{".gz", ".bloom"} {
+					if err = os.WriteFile(filepath.Join(dir, id.String()+ext), nil, 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			data, err := os.ReadFile(manifestPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = os.WriteFile(manifestPath, test.damage(data, edits), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			_, manifest, err = App{}.RecoverVersion(dir)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("RecoverVersion error is %v, want error %v", err, test.wantErr)
+			}
+			if manifest != nil {
+				manifest.Close()
+			}
+			for i, id := range ids {
+				kept := i == 0 || test.kept[i-1]
+				for _, ext := range []string{".gz", ".bloom"} {
+					_, err := os.Stat(filepath.Join(dir, id.String()+ext))
+					if exists := err == nil; exists != kept {
+						t.Errorf("%s of table %d exists: %v, want %v", ext, i, exists, kept)
+					}
+				}
+			}
+		})
+	}
+}
+
+// Only leveled compaction writes tables past level 0, the other strategies
+// use the default codec for every table.
+func TestNewCompressionLevels(t *testing.T) {
+	for _, strategy := range []string{"leveled", "tiered", "merge"} {
+		t.Run(strategy, func(t *testing.T) {
+			compression := App{}.NewCompression(config.LSMconfig{Compression: "zlib", LevelCompression: "0=none,2=gzip", CompactionStrategy: strategy})
+			want := []storage.CodecID{storage.CodecZlib, storage.CodecZlib, storage.CodecZlib}
+			if strategy == "leveled" {
+				want = []storage.CodecID{storage.CodecNone, storage.CodecZlib, storage.CodecGzip}
+			}
+			for level, id := range want {
+				if got := compression.ForLevel(level).ID(); got != id {
+					t.Errorf("level %d is written with %s, want %s", level, got, id)
+				}
+			}
+		})
+	}
+}
@@ -6,20 +6,82 @@ import (
 )
 
 type LSMconfig struct {
-	MtSize      uintptr
-	SSTsegLen   int64
-	SSTDir      string
-	JPath       string
-	GCperiodSec int
+	MtSize    uintptr
+	SSTsegLen int64
+	SSTDir    string
+	JPath     string
+	// MaxImmutableMemTables full memtables may wait for the flush before
+	// writes block.
+	MaxImmutableMemTables int
+	// MemTableKind is "skiplist" or "avl".
+	MemTableKind string
+
+	// WalSyncMode is "none", "always", "interval" or "bytes".
+	WalSyncMode       string
+	WalSyncIntervalMs int
+	WalSyncBytes      int64
+	WalSegmentSize    int64
+
+	GCperiodSec     int
+	BloomBitsPerKey int
+	BlockCacheSize  int64
+
+	// SnapshotLeaseSec is how long a snapshot handed out over HTTP lives
+	// after its last use.
+	SnapshotLeaseSec int
+
+	// Compression is the codec of new ssTables: "none", "gzip", "deflate" or
+	// "zlib", optionally followed by a colon and the level, e.g. "gzip:1".
+	Compression string
+	// LevelCompression overrides the codec per level, e.g. "0=none,1=gzip:1".
+	// Flushed tables are level 0. It is ignored unless CompactionStrategy is
+	// "leveled".
+	LevelCompression string
+
+	// CompactionStrategy is "merge" to merge every ssTable at once, "leveled"
+	// or "tiered".
+	CompactionStrategy  string
+	L0CompactionTrigger int
+	LevelBaseSize       int64
+	LevelSizeMultiplier int64
+	MaxLevels           int
+	TierMinThreshold    int
+	TierMaxThreshold    int
+	TierMinTableSize    int64
 }
 
 func New() *LSMconfig {
 	return &LSMconfig{
-		MtSize:      uintptr(getEnvAsInt("MTSIZE", 300)),
-		SSTsegLen:   int64(getEnvAsInt("SSTABLESEGLEN", 100)),
-		SSTDir:      getEnv("SSTABLEDIR", "ssTables"),
-		JPath:       getEnv("JOURNALPATH", "WAL"),
-		GCperiodSec: getEnvAsInt("GCPERIODSEC", 30),
+		MtSize:    uintptr(getEnvAsInt("MTSIZE", 300)),
+		SSTsegLen: int64(getEnvAsInt("SSTABLESEGLEN", 100)),
+		SSTDir:    getEnv("SSTABLEDIR", "ssTables"),
+		JPath:     getEnv("JOURNALPATH", "WAL"),
+
+		MaxImmutableMemTables: getEnvAsInt("MAXIMMUTABLEMEMTABLES", 2),
+		MemTableKind:          getEnv("MEMTABLE", "skiplist"),
+
+		WalSyncMode:       getEnv("WALSYNCMODE", "always"),
+		WalSyncIntervalMs: getEnvAsInt("WALSYNCINTERVALMS", 100),
+		WalSyncBytes:      int64(getEnvAsInt("WALSYNCBYTES", 1<<20)),
+		WalSegmentSize:    int64(getEnvAsInt("WALSEGMENTSIZE", 4<<20)),
+
+		GCperiodSec:     getEnvAsInt("GCPERIODSEC", 30),
+		BloomBitsPerKey: getEnvAsInt("BLOOMBITSPERKEY", 10),
+		BlockCacheSize:  int64(getEnvAsInt("BLOCKCACHESIZE", 8<<20)),
+
+		SnapshotLeaseSec: getEnvAsInt("SNAPSHOTLEASESEC", 60),
+
+		Compression:      getEnv("COMPRESSION", "gzip"),
+		LevelCompression: getEnv("LEVELCOMPRESSION", ""),
+
+		CompactionStrategy:  getEnv("COMPACTIONSTRATEGY", "merge"),
+		L0CompactionTrigger: getEnvAsInt("L0COMPACTIONTRIGGER", 4),
+		LevelBaseSize:       int64(getEnvAsInt("LEVELBASESIZE", 1<<20)),
+		LevelSizeMultiplier: int64(getEnvAsInt("LEVELSIZEMULTIPLIER", 10)),
+		MaxLevels:           getEnvAsInt("MAXLEVELS", 7),
+		TierMinThreshold:    getEnvAsInt("TIERMINTHRESHOLD", 4),
+		TierMaxThreshold:    getEnvAsInt("TIERMAXTHRESHOLD", 32),
+		TierMinTableSize:    int64(getEnvAsInt("TIERMINTABLESIZE", 4<<10)),
 	}
 }
 
@@ -3,26 +3,50 @@ package service
 import (
 	"PentHouseClub/internal/storage-service/storage"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 )
 
+const defaultScanLimit = 100
+
 type StorageService interface {
 	Get(w http.ResponseWriter, r *http.Request)
 	Set(w http.ResponseWriter, r *http.Request)
+	Delete(w http.ResponseWriter, r *http.Request)
+	Batch(w http.ResponseWriter, r *http.Request)
+	Scan(w http.ResponseWriter, r *http.Request)
+	Stats(w http.ResponseWriter, r *http.Request)
+	PauseCompaction(w http.ResponseWriter, r *http.Request)
+	ResumeCompaction(w http.ResponseWriter, r *http.Request)
+	TriggerCompaction(w http.ResponseWriter, r *http.Request)
+	CompactionStatus(w http.ResponseWriter, r *http.Request)
+	CreateSnapshot(w http.ResponseWriter, r *http.Request)
+	ReleaseSnapshot(w http.ResponseWriter, r *http.Request)
 }
 
 type StorageServiceImpl struct {
-	Storage storage.Storage
+	Storage   storage.Storage
+	Snapshots *SnapshotLeases
 }
 
+// Get returns the value of key, as of the snapshot parameter when given.
 func (storageService StorageServiceImpl) Get(w http.ResponseWriter, r *http.Request) {
 	key := r.URL.Query().Get("key")
-	value_channel := make(chan string)
-	getFunctionErr_channel := make(chan error)
-	go storageService.Storage.Get(key, value_channel, getFunctionErr_channel)
-	value, getFunctionErr := <-value_channel, <-getFunctionErr_channel
+	var value string
+	snapshot, getFunctionErr := storageService.snapshotOf(r)
+	if getFunctionErr == nil {
+		value_channel := make(chan string)
+		getFunctionErr_channel := make(chan error)
+		if snapshot != nil {
+			go snapshot.Get(key, value_channel, getFunctionErr_channel)
+		} else {
+			go storageService.Storage.Get(key, value_channel, getFunctionErr_channel)
+		}
+		value, getFunctionErr = <-value_channel, <-getFunctionErr_channel
+	}
 
 	respMessage := "OK"
 	respError := ""
@@ -37,6 +61,13 @@ func (storageService StorageServiceImpl) Get(w http.ResponseWriter, r *http.Requ
 	resp["value"] = value
 	resp["message"] = respMessage
 	resp["error"] = respError
+	if corruption := corruptionOf(getFunctionErr); corruption != nil {
+		resp["corrupted_table"] = corruption.Table.String()
+		resp["corrupted_offset"] = strconv.FormatInt(corruption.Offset, 10)
+		w.WriteHeader(http.StatusInternalServerError)
+	} else if snapshotGone(getFunctionErr) {
+		w.WriteHeader(http.StatusNotFound)
+	}
 	jsonResp, parseJsonErr := json.Marshal(resp)
 	if parseJsonErr != nil {
 		log.Printf("Error happened in JSON marshal. Err: %s", parseJsonErr)
@@ -78,3 +109,247 @@ func (storageService StorageServiceImpl) Set(w http.ResponseWriter, r *http.Requ
 
 	return
 }
+
+func (storageService StorageServiceImpl) Delete(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+
+	respMessage := "OK"
+	respError := ""
+	deleteFunctionErr_channel := make(chan error)
+	go storageService.Storage.Delete(key, deleteFunctionErr_channel)
+	deleteFunctionErr := <-deleteFunctionErr_channel
+	if deleteFunctionErr != nil {
+		respMessage = "FAILED"
+		respError = fmt.Sprintf("Delete function error. Err: %s", deleteFunctionErr)
+		log.Printf("Delete function error. Err: %s", deleteFunctionErr)
+	}
+
+	resp := make(map[string]string)
+	resp["status"] = respMessage
+	resp["error"] = respError
+	jsonResp, parseJsonErr := json.Marshal(resp)
+	if parseJsonErr != nil {
+		log.Printf("Error happened in JSON marshal. Err: %s", parseJsonErr)
+	}
+
+	if _, writeResponseErr := w.Write(jsonResp); writeResponseErr != nil {
+		log.Printf("Write response error. Err: %s", writeResponseErr)
+	}
+
+	return
+}
+
+type BatchOp struct {
+	// Op is "set" or "delete".
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type BatchReq struct {
+	Ops []BatchOp `json:"ops"`
+}
+
+// Batch applies the sets and deletes of the JSON request body atomically.
+func (storageService StorageServiceImpl) Batch(w http.ResponseWriter, r *http.Request) {
+	respMessage := "OK"
+	respError := ""
+	batch, parseBatchErr := parseBatch(r)
+	if parseBatchErr != nil {
+		respMessage = "FAILED"
+		respError = fmt.Sprintf("Parse batch error. Err: %s", parseBatchErr)
+		log.Printf("Parse batch error. Err: %s", parseBatchErr)
+		w.WriteHeader(http.StatusBadRequest)
+	} else {
+		batchFunctionErr_channel := make(chan error)
+		go storageService.Storage.Write(batch, batchFunctionErr_channel)
+		if batchFunctionErr := <-batchFunctionErr_channel; batchFunctionErr != nil {
+			respMessage = "FAILED"
+			respError = fmt.Sprintf("Batch function error. Err: %s", batchFunctionErr)
+			log.Printf("Batch function error. Err: %s", batchFunctionErr)
+		}
+	}
+
+	resp := make(map[string]string)
+	resp["status"] = respMessage
+	resp["error"] = respError
+	jsonResp, parseJsonErr := json.Marshal(resp)
+	if parseJsonErr != nil {
+		log.Printf("Error happened in JSON marshal. Err: %s", parseJsonErr)
+	}
+
+	if _, writeResponseErr := w.Write(jsonResp); writeResponseErr != nil {
+		log.Printf("Write response error. Err: %s", writeResponseErr)
+	}
+
+	return
+}
+
+func parseBatch(r *http.Request) (*storage.WriteBatch, error) {
+	var batchReq BatchReq
+	if err := json.NewDecoder(r.Body).Decode(&batchReq); err != nil {
+		return nil, err
+	}
+	batch := &storage.WriteBatch{}
+	for i, op := range batchReq.Ops {
+		switch op.Op {
+		case "set":
+			batch.Set(op.Key, op.Value)
+		case "delete":
+			batch.Delete(op.Key)
+		default:
+			return nil, fmt.Errorf("op %d: unknown op %q", i, op.Op)
+		}
+	}
+	return batch, nil
+}
+
+// corruptionOf returns the ssTable corruption that caused err, if any. Such
+// requests fail with 500 Internal Server Error.
+func corruptionOf(err error) *storage.ErrCorruption {
+	var corruption *storage.ErrCorruption
+	if errors.As(err, &corruption) {
+		return corruption
+	}
+	return nil
+}
+
+type ScanItem struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type ScanResp struct {
+	Items      []ScanItem             `json:"items"`
+	Next       string                 `json:"next"`
+	Message    string                 `json:"message"`
+	Error      string                 `json:"error"`
+	Corruption *storage.ErrCorruption `json:"corruption,omitempty"`
+}
+
+// Scan returns up to limit live entries in [start, end), or of the keys with the
+// given prefix. A non-empty next is the start of the following page. Pages read
+// at the same snapshot make up a consistent view of the storage.
+func (storageService StorageServiceImpl) Scan(w http.ResponseWriter, r *http.Request) {
+	start := r.URL.Query().Get("start")
+	end := r.URL.Query().Get("end")
+	prefix := r.URL.Query().Get("prefix")
+	limit, parseLimitErr := strconv.Atoi(r.URL.Query().Get("limit"))
+	if parseLimitErr != nil || limit <= 0 {
+		limit = defaultScanLimit
+	}
+	if prefix != "" {
+		if start < prefix {
+			start = prefix
+		}
+		prefixEnd := storage.PrefixEnd(prefix)
+		if end == "" || (prefixEnd != "" && prefixEnd < end) {
+			end = prefixEnd
+		}
+	}
+
+	var result []storage.KeyValue
+	snapshot, scanFunctionErr := storageService.snapshotOf(r)
+	if scanFunctionErr == nil {
+		result_channel := make(chan []storage.KeyValue)
+		scanFunctionErr_channel := make(chan error)
+		if snapshot != nil {
+			go snapshot.Scan(start, end, limit+1, result_channel, scanFunctionErr_channel)
+		} else {
+			go storageService.Storage.Scan(start, end, limit+1, result_channel, scanFunctionErr_channel)
+		}
+		result, scanFunctionErr = <-result_channel, <-scanFunctionErr_channel
+	}
+
+	resp := ScanResp{Items: make([]ScanItem, 0), Message: "OK"}
+	if scanFunctionErr != nil {
+		resp.Message = "FAILED"
+		resp.Error = fmt.Sprintf("Scan function error. Err: %s", scanFunctionErr)
+		log.Printf("Scan function error. Err: %s", scanFunctionErr)
+	}
+	if len(result) > limit {
+		result = result[:limit]
+		resp.Next = result[limit-1].Key + "\x00"
+	}
+	for _, keyValue := range result {
+		resp.Items = append(resp.Items, ScanItem{Key: keyValue.Key, Value: keyValue.Value})
+	}
+	if resp.Corruption = corruptionOf(scanFunctionErr); resp.Corruption != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	} else if snapshotGone(scanFunctionErr) {
+		w.WriteHeader(http.StatusNotFound)
+	}
+
+	jsonResp, parseJsonErr := json.Marshal(resp)
+	if parseJsonErr != nil {
+		log.Printf("Error happened in JSON marshal. Err: %s", parseJsonErr)
+	}
+
+	if _, writeResponseErr := w.Write(jsonResp); writeResponseErr != nil {
+		log.Printf("Write response error. Err: %s", writeResponseErr)
+	}
+
+	return
+}
+
+func (storageService StorageServiceImpl) Stats(w http.ResponseWriter, r *http.Request) {
+	stats_channel := make(chan map[string]int64)
+	go storageService.Storage.Stats(stats_channel)
+	stats := <-stats_channel
+
+	jsonResp, parseJsonErr := json.Marshal(stats)
+	if parseJsonErr != nil {
+		log.Printf("Error happened in JSON marshal. Err: %s", parseJsonErr)
+	}
+
+	if _, writeResponseErr := w.Write(jsonResp); writeResponseErr != nil {
+		log.Printf("Write response error. Err: %s", writeResponseErr)
+	}
+
+	return
+}
+
+type CompactionResp struct {
+	storage.CompactionState
+	Message string `json:"message"`
+	Error   string `json:"error"`
+}
+
+func (storageService StorageServiceImpl) PauseCompaction(w http.ResponseWriter, r *http.Request) {
+	state_channel := make(chan storage.CompactionState)
+	go storageService.Storage.PauseCompaction(state_channel)
+	writeCompactionState(w, <-state_channel)
+}
+
+func (storageService StorageServiceImpl) ResumeCompaction(w http.ResponseWriter, r *http.Request) {
+	state_channel := make(chan storage.CompactionState)
+	go storageService.Storage.ResumeCompaction(state_channel)
+	writeCompactionState(w, <-state_channel)
+}
+
+// TriggerCompaction starts a compaction run. With wait=true it responds once
+// the run is over.
+func (storageService StorageServiceImpl) TriggerCompaction(w http.ResponseWriter, r *http.Request) {
+	wait, _ := strconv.ParseBool(r.URL.Query().Get("wait"))
+	state_channel := make(chan storage.CompactionState)
+	go storageService.Storage.TriggerCompaction(wait, state_channel)
+	writeCompactionState(w, <-state_channel)
+}
+
+func (storageService StorageServiceImpl) CompactionStatus(w http.ResponseWriter, r *http.Request) {
+	state_channel := make(chan storage.CompactionState)
+	go storageService.Storage.CompactionStatus(state_channel)
+	writeCompactionState(w, <-state_channel)
+}
+
+func writeCompactionState(w http.ResponseWriter, state storage.CompactionState) {
+	resp := CompactionResp{CompactionState: state, Message: "OK"}
+	jsonResp, parseJsonErr := json.Marshal(resp)
+	if parseJsonErr != nil {
+		log.Printf("Error happened in JSON marshal. Err: %s", parseJsonErr)
+	}
+
+	if _, writeResponseErr := w.Write(jsonResp); writeResponseErr != nil {
+		log.Printf("Write response error. Err: %s", writeResponseErr)
+	}
+}
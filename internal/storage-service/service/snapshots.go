@@ -0,0 +1,156 @@
+package service
+
+import (
+	"PentHouseClub/internal/storage-service/storage"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var ErrUnknownSnapshot = errors.New("unknown or expired snapshot")
+
+// SnapshotLeases hands storage snapshots out to HTTP clients by id. Every
+// lease runs for Timeout from the last request made with it, then the
+// snapshot is released, so a client that goes away does not keep old versions
+// alive forever.
+type SnapshotLeases struct {
+	Timeout time.Duration
+	mutex   sync.Mutex
+	leases  map[string]*snapshotLease
+}
+
+type snapshotLease struct {
+	snapshot  *storage.Snapshot
+	timer     *time.Timer
+	expiresAt time.Time
+}
+
+func NewSnapshotLeases(timeout time.Duration) *SnapshotLeases {
+	return &SnapshotLeases{Timeout: timeout, leases: make(map[string]*snapshotLease)}
+}
+
+// Add leases snapshot under a new id.
+func (leases *SnapshotLeases) Add(snapshot *storage.Snapshot) (string, time.Time) {
+	id := uuid.New().String()
+	leases.mutex.Lock()
+	defer leases.mutex.Unlock()
+	lease := &snapshotLease{snapshot: snapshot, expiresAt: time.Now().Add(leases.Timeout)}
+	lease.timer = time.AfterFunc(leases.Timeout, func() {
+		if leases.Release(id) {
+			log.Printf("Snapshot %s lease expired", id)
+		}
+	})
+	leases.leases[id] = lease
+	return id, lease.expiresAt
+}
+
+// Acquire returns the snapshot leased under id and renews the lease.
+func (leases *SnapshotLeases) Acquire(id string) (*storage.Snapshot, time.Time, bool) {
+	leases.mutex.Lock()
+	defer leases.mutex.Unlock()
+	lease, ok := leases.leases[id]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	lease.timer.Reset(leases.Timeout)
+	lease.expiresAt = time.Now().Add(leases.Timeout)
+	return lease.snapshot, lease.expiresAt, true
+}
+
+// Release ends the lease of id and releases its snapshot. It reports whether
+// the lease was still held.
+func (leases *SnapshotLeases) Release(id string) bool {
+	leases.mutex.Lock()
+	lease, ok := leases.leases[id]
+	delete(leases.leases, id)
+	leases.mutex.Unlock()
+	if !ok {
+		return false
+	}
+	lease.timer.Stop()
+	lease.snapshot.Release()
+	return true
+}
+
+type SnapshotResp struct {
+	ID        string `json:"id"`
+	Seq       uint64 `json:"seq"`
+	LeaseSec  int    `json:"lease_sec"`
+	ExpiresAt string `json:"expires_at"`
+	Message   string `json:"message"`
+	Error     string `json:"error"`
+}
+
+// CreateSnapshot takes a snapshot and leases it. Passing the id as the
+// snapshot parameter of get and scan requests reads at the snapshot.
+func (storageService StorageServiceImpl) CreateSnapshot(w http.ResponseWriter, r *http.Request) {
+	snapshot_channel := make(chan *storage.Snapshot)
+	go storageService.Storage.Snapshot(snapshot_channel)
+	snapshot := <-snapshot_channel
+
+	id, expiresAt := storageService.Snapshots.Add(snapshot)
+	resp := SnapshotResp{
+		ID:        id,
+		Seq:       snapshot.Seq(),
+		LeaseSec:  int(storageService.Snapshots.Timeout / time.Second),
+		ExpiresAt: expiresAt.Format(time.RFC3339),
+		Message:   "OK",
+	}
+	jsonResp, parseJsonErr := json.Marshal(resp)
+	if parseJsonErr != nil {
+		log.Printf("Error happened in JSON marshal. Err: %s", parseJsonErr)
+	}
+
+	if _, writeResponseErr := w.Write(jsonResp); writeResponseErr != nil {
+		log.Printf("Write response error. Err: %s", writeResponseErr)
+	}
+}
+
+func (storageService StorageServiceImpl) ReleaseSnapshot(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+
+	respMessage := "OK"
+	respError := ""
+	if !storageService.Snapshots.Release(id) {
+		respMessage = "FAILED"
+		respError = fmt.Sprintf("Release snapshot %s error. Err: %s", id, ErrUnknownSnapshot)
+		w.WriteHeader(http.StatusNotFound)
+	}
+
+	resp := make(map[string]string)
+	resp["status"] = respMessage
+	resp["error"] = respError
+	jsonResp, parseJsonErr := json.Marshal(resp)
+	if parseJsonErr != nil {
+		log.Printf("Error happened in JSON marshal. Err: %s", parseJsonErr)
+	}
+
+	if _, writeResponseErr := w.Write(jsonResp); writeResponseErr != nil {
+		log.Printf("Write response error. Err: %s", writeResponseErr)
+	}
+}
+
+// snapshotOf returns the snapshot named by the snapshot parameter of r, nil
+// when there is none.
+func (storageService StorageServiceImpl) snapshotOf(r *http.Request) (*storage.Snapshot, error) {
+	id := r.URL.Query().Get("snapshot")
+	if id == "" {
+		return nil, nil
+	}
+	snapshot, _, ok := storageService.Snapshots.Acquire(id)
+	if !ok {
+		return nil, fmt.Errorf("snapshot %s: %w", id, ErrUnknownSnapshot)
+	}
+	return snapshot, nil
+}
+
+// snapshotGone tells whether err is a read at a snapshot that is no longer
+// leased. Such requests fail with 404 Not Found.
+func snapshotGone(err error) bool {
+	return errors.Is(err, ErrUnknownSnapshot) || errors.Is(err, storage.ErrSnapshotReleased)
+}
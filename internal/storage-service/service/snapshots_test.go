@@ -0,0 +1,73 @@
+package service
+
+import (
+	"PentHouseClub/internal/storage-service/storage"
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestSnapshot(t *testing.T) *storage.Snapshot {
+	t.Helper()
+	wal, _, err := storage.OpenWAL(t.TempDir(), storage.SyncPolicy{Mode: storage.SyncNone}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { wal.Close() })
+	storageImpl := &storage.StorageImpl{MemTable: storage.NewSkipListMemTable(1 << 20), SsTables: new([]storage.SsTable), Wal: wal}
+	snapshot_channel := make(chan *storage.Snapshot, 1)
+	storageImpl.Snapshot(snapshot_channel)
+	return <-snapshot_channel
+}
+
+func snapshotReleased(snapshot *storage.Snapshot) bool {
+	value_channel, err_channel := make(chan string, 1), make(chan error, 1)
+	snapshot.Get("key", value_channel, err_channel)
+	<-value_channel
+	return errors.Is(<-err_channel, storage.ErrSnapshotReleased)
+}
+
+// A lease not used for Timeout releases its snapshot, every use renews it.
+func TestSnapshotLeaseExpires(t *testing.T) {
+	leases := NewSnapshotLeases(100 * time.Millisecond)
+	snapshot := newTestSnapshot(t)
+	id, _ := leases.Add(snapshot)
+	for i := 0; i < 4; i++ {
+		time.Sleep(50 * time.Millisecond)
+		if acquired, _, ok := leases.Acquire(id); !ok || acquired != snapshot {
+			t.Fatalf("lease ended after %d renewals", i)
+		}
+	}
+	if snapshotReleased(snapshot) {
+		t.Fatal("renewed lease released its snapshot")
+	}
+	time.Sleep(300 * time.Millisecond)
+	if _, _, ok := leases.Acquire(id); ok {
+		t.Fatal("expired lease is still held")
+	}
+	if !snapshotReleased(snapshot) {
+		t.Fatal("expired lease did not release its snapshot")
+	}
+}
+
+// Releasing a lease releases its snapshot once.
+func TestSnapshotLeaseRelease(t *testing.T) {
+	leases := NewSnapshotLeases(time.Minute)
+	snapshot := newTestSnapshot(t)
+	id, _ := leases.Add(snapshot)
+	if !leases.Release(id) {
+		t.Fatal("Release of a held lease failed")
+	}
+	if !snapshotReleased(snapshot) {
+		t.Fatal("released lease kept its snapshot")
+	}
+	if leases.Release(id) {
+		t.Fatal("lease was released twice")
+	}
+	if _, _, ok := leases.Acquire(id); ok {
+		t.Fatal("released lease is still held")
+	}
+	if leases.Release("unknown") {
+		t.Fatal("Release of an unknown lease succeeded")
+	}
+}
@@ -3,44 +3,219 @@ package storage
 import (
 	"errors"
 	"gopkg.in/OlexiyKhokhlov/avltree.v2"
+	"math"
+	"sync"
 	"unsafe"
 )
 
-type MemTable struct {
-	AvlTree  *avltree.AVLTree[string, string]
-	MaxSize  uintptr
-	CurrSize *uintptr
+var (
+	ErrKeyNotFound  = errors.New("key was not found")
+	ErrKeyDeleted   = errors.New("key was deleted")
+	ErrMemTableFull = errors.New("MemTable size was exceeded")
+)
+
+// MaxSeq reads the latest version of every key.
+const MaxSeq uint64 = math.MaxUint64
+
+// Entry is a MemTable value. Deleted entries are tombstones: they hide
+// older values of the key stored in ssTables until compaction drops them.
+// Seq is the sequence number of the write and older the version it replaced.
+type Entry struct {
+	Value   string
+	Deleted bool
+	Seq     uint64
+	older   *Entry
 }
 
-func (memTable *MemTable) Add(key string, value string) error {
-	var pair = memTable.AvlTree.Find(key)
-	if pair != nil {
-		if *pair == value {
-			return nil
+// find returns the newest version not above seq.
+func (entry *Entry) find(seq uint64) *Entry {
+	for ; entry != nil; entry = entry.older {
+		if entry.Seq <= seq {
+			return entry
 		}
-		memTable.AvlTree.Erase(key)
-		memTable.AvlTree.Insert(key, value)
+	}
+	return nil
+}
+
+// entrySize is the memory an Entry version takes besides its value bytes.
+const entrySize = unsafe.Sizeof(Entry{})
+
+// MemTable keeps recent writes in memory. Every write adds a version of its
+// key, older versions are kept for the snapshots that may read them until the
+// MemTable is flushed. Size is the memory held by the keys, versions and
+// nodes; once it reaches MaxSize, Add and Delete report ErrMemTableFull after
+// storing the entry and the MemTable should be flushed. Implementations are
+// safe for concurrent use.
+type MemTable interface {
+	Add(key string, value string, seq uint64) error
+	Delete(key string, seq uint64) error
+	// Find returns the newest version of the key with a sequence number not
+	// above seq, ErrKeyDeleted for tombstones.
+	Find(key string, seq uint64) (string, error)
+	// NewIterator returns an iterator over every version of every key.
+	NewIterator() Iterator
+	Len() int
+	Size() uintptr
+	MaxSize() uintptr
+	// NewEmpty returns an empty MemTable of the same kind and size limit.
+	NewEmpty() MemTable
+}
+
+// NewMemTable returns a MemTable of the given kind, "skiplist" or "avl".
+func NewMemTable(kind string, maxSize uintptr) (MemTable, error) {
+	switch kind {
+	case "skiplist":
+		return NewSkipListMemTable(maxSize), nil
+	case "avl":
+		return NewAvlMemTable(maxSize), nil
+	}
+	return nil, errors.New("unknown MemTable kind " + kind)
+}
+
+// AvlMemTable is a MemTable on an AVL tree guarded by a single lock.
+type AvlMemTable struct {
+	mutex   sync.RWMutex
+	avlTree *avltree.AVLTree[string, Entry]
+	maxSize uintptr
+	size    uintptr
+}
+
+// avlNode mirrors the node layout of avltree.AVLTree[string, Entry].
+type avlNode struct {
+	key     string
+	value   Entry
+	links   [2]uintptr
+	balance int
+}
+
+// avlNodeOverhead is the memory an AvlMemTable entry takes besides its key and
+// value bytes.
+const avlNodeOverhead = unsafe.Sizeof(avlNode{})
+
+func NewAvlMemTable(maxSize uintptr) *AvlMemTable {
+	return &AvlMemTable{avlTree: avltree.NewAVLTreeOrderedKey[string, Entry](), maxSize: maxSize}
+}
+
+func avlEntrySize(key string, entry Entry) uintptr {
+	return avlNodeOverhead + uintptr(len(key)) + uintptr(len(entry.Value))
+}
+
+func (memTable *AvlMemTable) Add(key string, value string, seq uint64) error {
+	return memTable.put(key, Entry{Value: value, Seq: seq})
+}
+
+func (memTable *AvlMemTable) Delete(key string, seq uint64) error {
+	return memTable.put(key, Entry{Deleted: true, Seq: seq})
+}
+
+func (memTable *AvlMemTable) put(key string, entry Entry) error {
+	memTable.mutex.Lock()
+	defer memTable.mutex.Unlock()
+	var pair = memTable.avlTree.Find(key)
+	if pair != nil {
+		// The new version replaces the node value in place, avltree's Erase
+		// panics on some trees.
+		older := *pair
+		entry.older = &older
+		*pair = entry
+		memTable.size += entrySize + uintptr(len(entry.Value))
 	} else {
-		addSize := unsafe.Sizeof(key) + unsafe.Sizeof(value) + 8
-		memTable.AvlTree.Insert(key, value)
-		var newSize = *memTable.CurrSize + addSize
-		if newSize+addSize > memTable.MaxSize {
-			return errors.New("MemTable size was exceeded")
-		}
-		*memTable.CurrSize = newSize
+		memTable.avlTree.Insert(key, entry)
+		memTable.size += avlEntrySize(key, entry)
+	}
+	if memTable.size >= memTable.maxSize {
+		return ErrMemTableFull
 	}
 	return nil
 }
 
-func (memTable *MemTable) Find(key string) (string, error) {
-	val := memTable.AvlTree.Find(key)
+func (memTable *AvlMemTable) Find(key string, seq uint64) (string, error) {
+	memTable.mutex.RLock()
+	defer memTable.mutex.RUnlock()
+	val := memTable.avlTree.Find(key)
 	if val == nil {
-		return "", errors.New("key was not found")
+		return "", ErrKeyNotFound
+	}
+	version := val.find(seq)
+	if version == nil {
+		return "", ErrKeyNotFound
+	}
+	if version.Deleted {
+		return "", ErrKeyDeleted
+	}
+	return version.Value, nil
+}
+
+func (memTable *AvlMemTable) Len() int {
+	memTable.mutex.RLock()
+	defer memTable.mutex.RUnlock()
+	return int(memTable.avlTree.Size())
+}
+
+func (memTable *AvlMemTable) Size() uintptr {
+	memTable.mutex.RLock()
+	defer memTable.mutex.RUnlock()
+	return memTable.size
+}
+
+func (memTable *AvlMemTable) MaxSize() uintptr {
+	return memTable.maxSize
+}
+
+func (memTable *AvlMemTable) NewEmpty() MemTable {
+	return NewAvlMemTable(memTable.maxSize)
+}
+
+// NewIterator returns an iterator that looks every key up again, so writes
+// made while iterating are safe and may or may not be seen.
+func (memTable *AvlMemTable) NewIterator() Iterator {
+	return &avlIterator{memTable: memTable}
+}
+
+type avlIterator struct {
+	memTable *AvlMemTable
+	key      string
+	entry    *Entry
+}
+
+func (it *avlIterator) Seek(key string) bool {
+	it.memTable.mutex.RLock()
+	defer it.memTable.mutex.RUnlock()
+	if entry := it.memTable.avlTree.Find(key); entry != nil {
+		it.set(&key, entry)
+		return true
 	}
-	return *val, nil
+	it.set(it.memTable.avlTree.FindNextElement(key))
+	return it.entry != nil
 }
 
-func (memTable *MemTable) Clear() {
-	memTable.AvlTree.Clear()
-	*memTable.CurrSize = *new(uintptr)
+func (it *avlIterator) Next() bool {
+	if it.entry == nil {
+		return false
+	}
+	if it.entry.older != nil {
+		it.entry = it.entry.older
+		return true
+	}
+	it.memTable.mutex.RLock()
+	defer it.memTable.mutex.RUnlock()
+	it.set(it.memTable.avlTree.FindNextElement(it.key))
+	return it.entry != nil
+}
+
+// set copies the newest version out of the tree node, which a later write
+// replaces.
+func (it *avlIterator) set(key *string, entry *Entry) {
+	it.entry = nil
+	if entry != nil {
+		newest := *entry
+		it.key, it.entry = *key, &newest
+	}
 }
+
+func (it *avlIterator) Key() string   { return it.key }
+func (it *avlIterator) Value() string { return it.entry.Value }
+func (it *avlIterator) Deleted() bool { return it.entry.Deleted }
+func (it *avlIterator) Seq() uint64   { return it.entry.Seq }
+func (it *avlIterator) Err() error    { return nil }
+func (it *avlIterator) Close() error  { return nil }
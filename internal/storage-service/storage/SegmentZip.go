@@ -2,107 +2,258 @@ package storage
 
 import (
 	"bytes"
+	"compress/flate"
 	"compress/gzip"
+	"compress/zlib"
+	"fmt"
 	"io"
 	"log"
-	"os"
+	"strconv"
+	"strings"
 )
 
+// Zip compresses and decompresses ssTable segments.
 type Zip interface {
-	Zip(dirPath string, sparseIndex *map[string]SparseIndices, segmentLength int64) (string, map[string]SparseIndices, int64)
-	Unzip(segment *[]byte) []byte
+	// ID is the codec recorded in the table index for segments the codec wrote.
+	ID() CodecID
+	Zip(segment []byte) ([]byte, error)
+	Unzip(segment *[]byte) ([]byte, error)
 }
 
-type GZip struct{}
+// CodecID identifies the codec of a segment in the table index, so tables
+// written with different codecs are read side by side. Tables written before
+// codecs were recorded hold gzip segments only, hence gzip is the zero value.
+type CodecID byte
 
-func (z GZip) Zip(dirPath string, sparseIndex *map[string]SparseIndices, segmentLength int64) (string, map[string]SparseIndices, int64) {
-	file, err := os.OpenFile(dirPath, os.O_RDONLY, 0644)
-	if err != nil {
-		log.Printf("Open sstable file error. Err: %s", err)
+const (
+	CodecGzip CodecID = iota
+	CodecNone
+	CodecDeflate
+	CodecZlib
+)
+
+var codecNames = map[CodecID]string{
+	CodecGzip:    "gzip",
+	CodecNone:    "none",
+	CodecDeflate: "deflate",
+	CodecZlib:    "zlib",
+}
+
+func (id CodecID) String() string {
+	if name, ok := codecNames[id]; ok {
+		return name
 	}
-	defer func() {
-		if err = file.Close(); err != nil {
-			log.Printf("Close sstable file error. Err: %s", err)
-		}
-	}()
+	return fmt.Sprintf("codec(%d)", byte(id))
+}
 
-	ndp := dirPath[:len(dirPath)-4] + ".gz"
-	cf, err := os.OpenFile(ndp, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Printf("Zip sstable file error. Err: %s", err)
+// DefaultLevel is the level of codecs compressing at their default level.
+// Zero cannot stand for it: it is flate.NoCompression.
+const DefaultLevel = flate.DefaultCompression
+
+// NewCodec returns the codec of id compressing at level, the level is ignored
+// by codecs without levels.
+func NewCodec(id CodecID, level int) (Zip, error) {
+	hasLevel := level != DefaultLevel
+	switch id {
+	case CodecGzip:
+		return GZip{Level: level, HasLevel: hasLevel}, nil
+	case CodecNone:
+		return NoZip{}, nil
+	case CodecDeflate:
+		return Deflate{Level: level, HasLevel: hasLevel}, nil
+	case CodecZlib:
+		return ZLib{Level: level, HasLevel: hasLevel}, nil
 	}
-	defer func(compressedFile *os.File) {
-		err := compressedFile.Close()
-		if err != nil {
-			log.Printf("Close sstable file error. Err: %s", err)
-		}
-	}(cf)
-
-	i := *sparseIndex
-	newI := make(map[string]SparseIndices)
-	newSeg := int64(0)
-	newSegLen := int64(0)
-	f := false
-	for keyTable := range i {
-		sedLen := i[keyTable].start
-		_, err = file.Seek(sedLen, 0)
-		if err != nil {
-			log.Printf("Segment sstable file error. Err: %s", err)
-		}
-		data := make([]byte, segmentLength)
-		_, err := file.Read(data)
-		if err != nil {
-			log.Printf("Segment sstable file error. Err: %s", err)
-		}
+	return nil, fmt.Errorf("unknown codec %s", id)
+}
 
-		var cBuff bytes.Buffer
-		buffWriter := gzip.NewWriter(&cBuff)
-		_, err = buffWriter.Write(data)
-		if err != nil {
-			log.Printf("Segment sstable file error. Err: %s", err)
+// ParseCodec reads a codec spec, the codec name optionally followed by a colon
+// and the level, e.g. "none", "zlib" or "gzip:1".
+func ParseCodec(spec string) (Zip, error) {
+	name, levelSpec, hasLevel := strings.Cut(strings.TrimSpace(spec), ":")
+	level := DefaultLevel
+	if hasLevel {
+		var err error
+		if level, err = strconv.Atoi(levelSpec); err != nil || level < flate.HuffmanOnly || level > flate.BestCompression {
+			return nil, fmt.Errorf("bad compression level %q", levelSpec)
 		}
-		err = buffWriter.Close()
-		if err != nil {
-			log.Printf("Segment sstable file error. Err: %s", err)
+	}
+	for id, codecName := range codecNames {
+		if codecName == name {
+			return NewCodec(id, level)
 		}
+	}
+	return nil, fmt.Errorf("unknown codec %q", name)
+}
 
-		n2, err := cf.Write(cBuff.Bytes())
-		if err != nil {
-			log.Printf("Zip sstable segment error. Err: %s", err)
-		}
-		newI[keyTable] = SparseIndices{newSeg, int64(n2)}
-		newSeg += int64(n2)
+// Compression picks the codec of new ssTables by the level they are written
+// to. The zero Compression writes gzip at the default level everywhere.
+type Compression struct {
+	Default Zip
+	Levels  map[int]Zip
+}
 
-		if f == false {
-			newSegLen = int64(n2)
-			f = true
+// ParseCompression reads the default codec spec and a comma separated list of
+// level=codec overrides, e.g. "0=none,1=gzip:1".
+func ParseCompression(defaultSpec string, levelSpecs string) (Compression, error) {
+	var compression Compression
+	var err error
+	if compression.Default, err = ParseCodec(defaultSpec); err != nil {
+		return Compression{}, err
+	}
+	for _, levelSpec := range strings.Split(levelSpecs, ",") {
+		if strings.TrimSpace(levelSpec) == "" {
+			continue
+		}
+		levelName, codecSpec, ok := strings.Cut(levelSpec, "=")
+		level, err := strconv.Atoi(strings.TrimSpace(levelName))
+		if !ok || err != nil || level < 0 {
+			return Compression{}, fmt.Errorf("bad level compression %q", levelSpec)
 		}
+		codec, err := ParseCodec(codecSpec)
 		if err != nil {
-			log.Printf("Index zip sstable segment error. Err: %s", err)
+			return Compression{}, err
+		}
+		if compression.Levels == nil {
+			compression.Levels = make(map[int]Zip)
 		}
+		compression.Levels[level] = codec
 	}
+	return compression, nil
+}
 
-	return ndp, newI, newSegLen
+// ForLevel returns the codec of tables written to level.
+func (compression Compression) ForLevel(level int) Zip {
+	if codec, ok := compression.Levels[level]; ok {
+		return codec
+	}
+	if compression.Default != nil {
+		return compression.Default
+	}
+	return GZip{}
 }
 
-func (z GZip) Unzip(segment *[]byte) []byte {
-	var decompBuff bytes.Buffer
+// NoZip stores segments uncompressed.
+type NoZip struct{}
+
+func (z NoZip) ID() CodecID {
+	return CodecNone
+}
+
+func (z NoZip) Zip(segment []byte) ([]byte, error) {
+	return segment, nil
+}
+
+func (z NoZip) Unzip(segment *[]byte) ([]byte, error) {
+	return *segment, nil
+}
+
+// GZip compresses segments with gzip at Level when HasLevel is set and at the
+// default level otherwise, so the zero GZip compresses at the default level.
+type GZip struct {
+	Level    int
+	HasLevel bool
+}
 
-	reader, err := gzip.NewReader(io.NopCloser(bytes.NewBuffer(*segment)))
+func (z GZip) ID() CodecID {
+	return CodecGzip
+}
+
+func (z GZip) Zip(segment []byte) ([]byte, error) {
+	var cBuff bytes.Buffer
+	buffWriter, err := gzip.NewWriterLevel(&cBuff, codecLevel(z.Level, z.HasLevel))
 	if err != nil {
-		log.Printf("Read sstable segment error. Err: %s", err)
+		return nil, err
 	}
-	defer func(reader *gzip.Reader) {
-		err := reader.Close()
-		if err != nil {
-			log.Printf("Close sstable file error. Err: %s", err)
-		}
-	}(reader)
+	return compress(buffWriter, &cBuff, segment)
+}
+
+func (z GZip) Unzip(segment *[]byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(*segment))
+	if err != nil {
+		return nil, err
+	}
+	return decompress(reader)
+}
+
+// Deflate compresses segments with raw DEFLATE at Level when HasLevel is set
+// and at the default level otherwise.
+type Deflate struct {
+	Level    int
+	HasLevel bool
+}
+
+func (z Deflate) ID() CodecID {
+	return CodecDeflate
+}
+
+func (z Deflate) Zip(segment []byte) ([]byte, error) {
+	var cBuff bytes.Buffer
+	buffWriter, err := flate.NewWriter(&cBuff, codecLevel(z.Level, z.HasLevel))
+	if err != nil {
+		return nil, err
+	}
+	return compress(buffWriter, &cBuff, segment)
+}
+
+func (z Deflate) Unzip(segment *[]byte) ([]byte, error) {
+	return decompress(flate.NewReader(bytes.NewReader(*segment)))
+}
+
+// ZLib compresses segments with zlib at Level when HasLevel is set and at the
+// default level otherwise.
+type ZLib struct {
+	Level    int
+	HasLevel bool
+}
+
+func (z ZLib) ID() CodecID {
+	return CodecZlib
+}
 
-	_, err = io.Copy(&decompBuff, reader)
+func (z ZLib) Zip(segment []byte) ([]byte, error) {
+	var cBuff bytes.Buffer
+	buffWriter, err := zlib.NewWriterLevel(&cBuff, codecLevel(z.Level, z.HasLevel))
 	if err != nil {
-		log.Printf("Unzip sstable segment error. Err: %s", err)
+		return nil, err
 	}
+	return compress(buffWriter, &cBuff, segment)
+}
+
+func (z ZLib) Unzip(segment *[]byte) ([]byte, error) {
+	reader, err := zlib.NewReader(bytes.NewReader(*segment))
+	if err != nil {
+		return nil, err
+	}
+	return decompress(reader)
+}
+
+func codecLevel(level int, hasLevel bool) int {
+	if !hasLevel {
+		return DefaultLevel
+	}
+	return level
+}
 
-	return decompBuff.Bytes()
+func compress(writer io.WriteCloser, buffer *bytes.Buffer, segment []byte) ([]byte, error) {
+	if _, err := writer.Write(segment); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func decompress(reader io.ReadCloser) ([]byte, error) {
+	defer func() {
+		if err := reader.Close(); err != nil {
+			log.Printf("Close sstable file error. Err: %s", err)
+		}
+	}()
+	var decompBuff bytes.Buffer
+	if _, err := io.Copy(&decompBuff, reader); err != nil {
+		return nil, err
+	}
+	return decompBuff.Bytes(), nil
 }
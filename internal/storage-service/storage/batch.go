@@ -0,0 +1,78 @@
+package storage
+
+import "sort"
+
+// WriteBatch collects sets and deletes that Write applies atomically: the
+// batch is logged as one journal record and stored under one sequence number,
+// so readers and crash recovery see all of it or none. When a batch writes a
+// key more than once, the last write wins.
+type WriteBatch struct {
+	entries []KeyValue
+}
+
+func (batch *WriteBatch) Set(key string, value string) {
+	batch.entries = append(batch.entries, KeyValue{Key: key, Value: value})
+}
+
+func (batch *WriteBatch) Delete(key string) {
+	batch.entries = append(batch.entries, KeyValue{Key: key, Deleted: true})
+}
+
+// Len is the number of writes in the batch.
+func (batch *WriteBatch) Len() int {
+	return len(batch.entries)
+}
+
+// writes returns the last write of every key in the batch, in the order the
+// keys were first written. Versions of a key must have distinct sequence
+// numbers, so a batch never stores a key twice.
+func (batch *WriteBatch) writes() []KeyValue {
+	positions := make(map[string]int, len(batch.entries))
+	writes := make([]KeyValue, 0, len(batch.entries))
+	for _, entry := range batch.entries {
+		if i, ok := positions[entry.Key]; ok {
+			writes[i] = entry
+			continue
+		}
+		positions[entry.Key] = len(writes)
+		writes = append(writes, entry)
+	}
+	return writes
+}
+
+// Write applies the batch and acknowledges it once its journal record is as
+// durable as the WAL sync policy asks. An empty batch writes nothing. Like a
+// single write, a batch whose record could not be synced is applied and
+// reported as ErrNotSynced.
+func (storage *StorageImpl) Write(batch *WriteBatch, getFunctionErr_channel chan<- error) {
+	writes := batch.writes()
+	if len(writes) == 0 {
+		getFunctionErr_channel <- nil
+		return
+	}
+	getFunctionErr_channel <- storage.write(writes)
+}
+
+// lockKeys takes the key locks of the writes in index order, so writers of
+// overlapping batches do not deadlock, and returns the function releasing
+// them.
+func (storage *StorageImpl) lockKeys(writes []KeyValue) func() {
+	indices := make([]uint32, 0, len(writes))
+	taken := make(map[uint32]bool, len(writes))
+	for _, write := range writes {
+		index := keyLockIndex(write.Key)
+		if !taken[index] {
+			taken[index] = true
+			indices = append(indices, index)
+		}
+	}
+	sort.Slice(indices, func(i, j int) bool { return indices[i] < indices[j] })
+	for _, index := range indices {
+		storage.keyLocks[index].Lock()
+	}
+	return func() {
+		for _, index := range indices {
+			storage.keyLocks[index].Unlock()
+		}
+	}
+}
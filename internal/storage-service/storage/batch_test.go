@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+)
+
+// A batch is stored under one sequence number, the last write of a key wins.
+func TestWriteBatch(t *testing.T) {
+	storage := newTestStorage(t, 1<<20, 1000)
+	if err := testSet(storage, "c", "old"); err != nil {
+		t.Fatal(err)
+	}
+	batch := &WriteBatch{}
+	batch.Set("a", "1")
+	batch.Set("b", "2")
+	batch.Delete("c")
+	batch.Set("a", "3")
+	batch.Delete("b")
+	if err := testWrite(storage, batch); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := testGet(storage, "a"); err != nil || value != "3" {
+		t.Fatalf("a reads as %q, %v, want 3", value, err)
+	}
+	for _, key := range []string{"b", "c"} {
+		if value, err := testGet(storage, key); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("deleted %s reads as %q, %v", key, value, err)
+		}
+	}
+	if seq := storage.Wal.LastSeq(); seq != 2 {
+		t.Fatalf("batch ends at seq %d, want 2", seq)
+	}
+	if err := testWrite(storage, &WriteBatch{}); err != nil || storage.Wal.LastSeq() != 2 {
+		t.Fatalf("empty batch wrote seq %d, %v", storage.Wal.LastSeq(), err)
+	}
+}
+
+// Batches writing the same keys concurrently are applied whole: every snapshot
+// and the final state hold the values of one batch for all its keys.
+func TestWriteBatchAtomicUnderConcurrentWrites(t *testing.T) {
+	storage := newTestStorage(t, 2000, 200)
+	const writers, rounds, keys = 8, 40, 10
+	var wg sync.WaitGroup
+	for writer := 0; writer < writers; writer++ {
+		wg.Add(1)
+		go func(writer int) {
+			defer wg.Done()
+			for round := 0; round < rounds; round++ {
+				batch := &WriteBatch{}
+				// Every writer takes the keys in its own order.
+				for i := 0; i < keys; i++ {
+					batch.Set(fmt.Sprintf("key%02d", (i*7+writer)%keys), fmt.Sprintf("writer%d-round%d", writer, round))
+				}
+				if err := testWrite(storage, batch); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(writer)
+	}
+	checkWhole := func(keyValues []KeyValue, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, keyValue := range keyValues {
+			if keyValue.Value != keyValues[0].Value {
+				t.Fatalf("read a torn batch %+v", keyValues)
+			}
+		}
+	}
+	for i := 0; i < 30; i++ {
+		snapshot := testSnapshot(storage)
+		checkWhole(testSnapshotScan(snapshot, "key", "kez"))
+		snapshot.Release()
+	}
+	wg.Wait()
+	waitFlushed(storage)
+	storage.compact()
+	keyValues, err := testScan(storage, "key", "kez", 0)
+	if len(keyValues) != keys {
+		t.Fatalf("scan read %d keys, want %d", len(keyValues), keys)
+	}
+	checkWhole(keyValues, err)
+	if seq := storage.Wal.LastSeq(); seq != writers*rounds {
+		t.Fatalf("batches end at seq %d, want %d", seq, writers*rounds)
+	}
+}
+
+// A batch is replayed as one journal record with its sequence number, and a
+// torn batch record is dropped whole.
+func TestWriteBatchReplay(t *testing.T) {
+	dir := t.TempDir()
+	wal, _ := openTestWAL(t, dir)
+	storage := &StorageImpl{MemTable: NewSkipListMemTable(1 << 20), SsTables: new([]SsTable), Wal: wal}
+	if err := testSet(storage, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	batch := &WriteBatch{}
+	batch.Set("b", "2")
+	batch.Delete("a")
+	batch.Set("c", "3")
+	if err := testWrite(storage, batch); err != nil {
+		t.Fatal(err)
+	}
+	torn := &WriteBatch{}
+	torn.Set("d", "4")
+	torn.Set("e", "5")
+	if err := testWrite(storage, torn); err != nil {
+		t.Fatal(err)
+	}
+	path := wal.segmentPath(wal.segment)
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(path, data[:len(data)-3], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	wal, records := openTestWAL(t, dir)
+	defer wal.Close()
+	if len(records) != 2 {
+		t.Fatalf("replayed %d records %+v, want 2", len(records), records)
+	}
+	want := []KeyValue{{Key: "b", Value: "2"}, {Key: "a", Deleted: true}, {Key: "c", Value: "3"}}
+	if record := records[1]; record.Seq != 2 || len(record.Entries) != len(want) {
+		t.Fatalf("batch replayed as %+v, want seq 2 and %+v", record, want)
+	}
+	for i, entry := range records[1].Entries {
+		if entry.Key != want[i].Key || entry.Value != want[i].Value || entry.Deleted != want[i].Deleted {
+			t.Fatalf("batch entry %d replayed as %+v, want %+v", i, entry, want[i])
+		}
+	}
+	if seq, err := wal.Append([]KeyValue{{Key: "f", Value: "6"}}); err != nil || seq != 3 {
+		t.Fatalf("append after the torn batch got seq %d, %v, want 3", seq, err)
+	}
+}
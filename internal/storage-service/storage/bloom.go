@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Bloom filter files hold
+//
+//	magic (6) | hash count (1) | bit count (8) | bits | CRC32-C (4)
+//
+// the checksum covering everything before it.
+var bloomMagic = []byte("PHBLM\x02")
+
+// BloomFilter answers whether a key may be in an ssTable. False positives are
+// possible, false negatives are not.
+type BloomFilter struct {
+	bits      []byte
+	hashCount uint8
+}
+
+func NewBloomFilter(keys []string, bitsPerKey int) *BloomFilter {
+	bitCount := len(keys) * bitsPerKey
+	if bitCount < 64 {
+		bitCount = 64
+	}
+	// ln(2) * bitsPerKey hash functions minimize the false positive rate.
+	hashCount := int(float64(bitsPerKey) * 0.69)
+	if hashCount < 1 {
+		hashCount = 1
+	}
+	if hashCount > 30 {
+		hashCount = 30
+	}
+	filter := &BloomFilter{bits: make([]byte, (bitCount+7)/8), hashCount: uint8(hashCount)}
+	for _, key := range keys {
+		filter.add(key)
+	}
+	return filter
+}
+
+// positions returns the bit positions of the key using double hashing.
+func (filter *BloomFilter) positions(key string, f func(bit uint64) bool) {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	sum := hash.Sum64()
+	h1, h2 := sum&0xffffffff, sum>>32|1
+	bitCount := uint64(len(filter.bits)) * 8
+	for i := uint64(0); i < uint64(filter.hashCount); i++ {
+		if !f((h1 + i*h2) % bitCount) {
+			return
+		}
+	}
+}
+
+func (filter *BloomFilter) add(key string) {
+	filter.positions(key, func(bit uint64) bool {
+		filter.bits[bit/8] |= 1 << (bit % 8)
+		return true
+	})
+}
+
+func (filter *BloomFilter) MayContain(key string) bool {
+	result := true
+	filter.positions(key, func(bit uint64) bool {
+		result = filter.bits[bit/8]&(1<<(bit%8)) != 0
+		return result
+	})
+	return result
+}
+
+// Save writes the filter to a temporary file and renames it to path once it
+// is synced, so a crash leaves the previous file or the whole new one.
+func (filter *BloomFilter) Save(path string) error {
+	data := append(append([]byte{}, bloomMagic...), filter.hashCount)
+	data = binary.LittleEndian.AppendUint64(data, uint64(len(filter.bits))*8)
+	data = append(data, filter.bits...)
+	data = binary.LittleEndian.AppendUint32(data, crc32.Checksum(data, crcTable))
+
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// LoadBloomFilter reads the filter saved at path. A filter that fails its
+// checks is not returned: reads then go to the table.
+func LoadBloomFilter(path string) (*BloomFilter, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	const headerSize = 6 + 1 + 8
+	if !bytes.HasPrefix(data, bloomMagic) || len(data) < headerSize+4 {
+		return nil, errors.New("broken bloom filter file")
+	}
+	body := data[:len(data)-4]
+	if crc32.Checksum(body, crcTable) != binary.LittleEndian.Uint32(data[len(data)-4:]) {
+		return nil, errors.New("bloom filter checksum mismatch")
+	}
+	hashCount := body[len(bloomMagic)]
+	bitCount := binary.LittleEndian.Uint64(body[len(bloomMagic)+1:])
+	bits := body[headerSize:]
+	if hashCount == 0 || len(bits) == 0 || bitCount != uint64(len(bits))*8 {
+		return nil, fmt.Errorf("bloom filter holds %d bytes of bits, its header says %d bits", len(bits), bitCount)
+	}
+	return &BloomFilter{hashCount: hashCount, bits: bits}, nil
+}
+
+// buildBloomFilter builds and saves the filter of a new table before the table
+// is logged in the manifest. Tables are usable without a filter, so errors are
+// only logged.
+func (table *SsTable) buildBloomFilter(keys []string) {
+	if table.bloomBitsPerKey <= 0 {
+		return
+	}
+	table.bloom = NewBloomFilter(keys, table.bloomBitsPerKey)
+	if err := table.bloom.Save(table.bPath); err != nil {
+		log.Printf("Save bloom filter of ssTable with id %s error. Err: %s", table.id.String(), err)
+	}
+}
@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+// writeBloomTestTable writes a table of 100 keys with a bloom filter to dir.
+func writeBloomTestTable(t *testing.T, dir string) (SsTable, []KeyValue) {
+	t.Helper()
+	keyValues := make([]KeyValue, 0, 100)
+	for i := 0; i < 100; i++ {
+		keyValues = append(keyValues, KeyValue{Key: fmt.Sprintf("key%03d", i), Value: fmt.Sprintf("value%d", i), Seq: uint64(i + 1)})
+	}
+	return *writeTestTable(t, dir, 200, keyValues), keyValues
+}
+
+func TestBloomFilterSaveLoad(t *testing.T) {
+	table, keyValues := writeBloomTestTable(t, t.TempDir())
+	filter, err := LoadBloomFilter(table.bPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, keyValue := range keyValues {
+		if !filter.MayContain(keyValue.Key) {
+			t.Fatalf("loaded filter misses key %q", keyValue.Key)
+		}
+	}
+	if _, err := os.Stat(table.bPath + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("temporary filter file is left behind: %v", err)
+	}
+}
+
+// A damaged filter must not be used: it would answer that present keys are
+// absent. Reads fall back to the table.
+func TestDamagedBloomFilterIsDiscarded(t *testing.T) {
+	// The damage is done at the start of the bits, after the magic, the hash
+	// count and the bit count.
+	bitsOffset := len(bloomMagic) + 1 + 8
+	tests := []struct {
+		name   string
+		damage fileDamage
+	}{
+		{"truncated in the bits", cutAt(60)},
+		{"truncated to the header", cutAt(0)},
+		{"last byte cut", cutEnd(1)},
+		{"bit flipped", flipBits(60, 0x10)},
+		{"hash count zeroed", setTo(-9, 0)},
+		{"bit count grown", addTo(-8, 8)},
+		{"zeroed bits", zeroOut(0, -4)},
+		{"checksum bit flipped", func(data []byte, base int) []byte { data[len(data)-2] ^= 0x01; return data }},
+		{"empty", func(data []byte, base int) []byte { return nil }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			table, keyValues := writeBloomTestTable(t, dir)
+			damageFile(t, table.bPath, test.damage, bitsOffset)
+			if _, err := LoadBloomFilter(table.bPath); err == nil {
+				t.Fatal("LoadBloomFilter accepted a damaged filter")
+			}
+
+			reopened := Restore(table.dPath, "", nil)
+			if reopened.bloom != nil {
+				t.Fatal("Restore kept a damaged filter")
+			}
+			for _, keyValue := range keyValues {
+				value, err := reopened.Find(keyValue.Key, MaxSeq)
+				if err != nil || value != keyValue.Value {
+					t.Fatalf("Find(%q) = %q, %v, want %q", keyValue.Key, value, err, keyValue.Value)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"hash/crc32"
+	"log"
+	"os"
+)
+
+// tableBuilder writes a table file in a single pass. Records are gathered into
+// a segment of up to segLen uncompressed bytes, which is compressed and
+// appended to the file as soon as the next record does not fit. The index
+// entry of a segment records its exact offset and length and its first and
+// last key. The versions of a key are never split between segments, so a
+// segment may exceed segLen, a record larger than segLen gets a segment of its
+// own.
+type tableBuilder struct {
+	table   *SsTable
+	file    *os.File
+	offset  int64
+	segment []byte
+	first   string
+	last    string
+	keys    []string
+}
+
+// newTableBuilder creates the file of the table at table.dPath.
+func newTableBuilder(table *SsTable) (*tableBuilder, error) {
+	file, err := os.OpenFile(table.dPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if table.codec == nil {
+		table.codec = GZip{}
+	}
+	table.format = seqRecordSegmentFormat
+	table.ind = make(SparseIndex, 0)
+	return &tableBuilder{table: table, file: file, keys: make([]string, 0)}, nil
+}
+
+// add appends a record. Keys must be added in ascending order, the versions of
+// a key newest first.
+func (builder *tableBuilder) add(keyValue KeyValue) error {
+	if len(builder.segment) != 0 && keyValue.Key == builder.last {
+		builder.segment = appendSeqRecord(builder.segment, keyValue)
+		return nil
+	}
+	size := int64(seqRecordSize(keyValue))
+	if len(builder.segment) != 0 && int64(len(builder.segment))+size > builder.table.segLen {
+		if err := builder.flushSegment(); err != nil {
+			return err
+		}
+	}
+	if len(builder.segment) == 0 {
+		builder.first = keyValue.Key
+	}
+	builder.segment = appendSeqRecord(builder.segment, keyValue)
+	builder.last = keyValue.Key
+	builder.keys = append(builder.keys, keyValue.Key)
+	return nil
+}
+
+// flushSegment compresses the pending segment and appends it to the file. A
+// segment that does not shrink is stored as is.
+func (builder *tableBuilder) flushSegment() error {
+	codec := builder.table.codec.ID()
+	data, err := builder.table.codec.Zip(builder.segment)
+	if err != nil {
+		return err
+	}
+	if len(data) >= len(builder.segment) {
+		codec, data = CodecNone, builder.segment
+	}
+	if _, err = builder.file.Write(data); err != nil {
+		return err
+	}
+	builder.table.ind = append(builder.table.ind, IndexEntry{key: builder.first, lastKey: builder.last,
+		SparseIndices: SparseIndices{builder.offset, builder.offset + int64(len(data))},
+		checksum:      crc32.Checksum(data, crcTable), codec: codec})
+	builder.offset += int64(len(data))
+	builder.segment = builder.segment[:0]
+	return nil
+}
+
+// finish writes the last segment, the index block and the bloom filter and
+// syncs the table file.
+func (builder *tableBuilder) finish() error {
+	if len(builder.segment) != 0 {
+		if err := builder.flushSegment(); err != nil {
+			return err
+		}
+	}
+	builder.table.segmentsEnd = builder.offset
+	if _, err := builder.file.Write(builder.table.indexBlock(builder.offset)); err != nil {
+		return err
+	}
+	if err := builder.file.Sync(); err != nil {
+		return err
+	}
+	if err := builder.file.Close(); err != nil {
+		return err
+	}
+	builder.table.buildBloomFilter(builder.keys)
+	builder.table.last = knownLastKey(builder.last)
+	builder.table.size = fileSize(builder.table.dPath)
+	builder.table.refs = newTableRefs()
+	return nil
+}
+
+// abandon closes and removes the partly written table file.
+func (builder *tableBuilder) abandon() {
+	if err := builder.file.Close(); err != nil {
+		log.Printf("Close sstable file error. Err: %s", err)
+	}
+	if err := os.Remove(builder.table.dPath); err != nil {
+		log.Printf("Remove sstable file error. Err: %s", err)
+	}
+}
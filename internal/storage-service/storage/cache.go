@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"container/list"
+	"github.com/google/uuid"
+	"sync"
+)
+
+type blockKey struct {
+	table  uuid.UUID
+	offset int64
+}
+
+type block struct {
+	key     blockKey
+	entries []KeyValue
+	size    int64
+}
+
+// BlockCache is an LRU cache of decoded ssTable segments shared by all tables.
+// Its size is the decompressed size of the cached segments. A nil cache
+// caches nothing.
+type BlockCache struct {
+	mutex    sync.Mutex
+	capacity int64
+	size     int64
+	lru      *list.List
+	blocks   map[blockKey]*list.Element
+}
+
+func NewBlockCache(capacity int64) *BlockCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &BlockCache{capacity: capacity, lru: list.New(), blocks: make(map[blockKey]*list.Element)}
+}
+
+func (cache *BlockCache) Get(table uuid.UUID, offset int64) ([]KeyValue, bool) {
+	if cache == nil {
+		return nil, false
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	element, ok := cache.blocks[blockKey{table, offset}]
+	if !ok {
+		StorageStats.BlockCacheMisses.Add(1)
+		return nil, false
+	}
+	StorageStats.BlockCacheHits.Add(1)
+	cache.lru.MoveToFront(element)
+	return element.Value.(*block).entries, true
+}
+
+// Put caches the segment. Cached entries are shared and must not be modified.
+func (cache *BlockCache) Put(table uuid.UUID, offset int64, entries []KeyValue, size int64) {
+	if cache == nil || size > cache.capacity {
+		return
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	key := blockKey{table, offset}
+	if element, ok := cache.blocks[key]; ok {
+		cache.remove(element)
+	}
+	cache.blocks[key] = cache.lru.PushFront(&block{key: key, entries: entries, size: size})
+	cache.size += size
+	for cache.size > cache.capacity {
+		cache.remove(cache.lru.Back())
+	}
+	StorageStats.BlockCacheSize.Store(cache.size)
+}
+
+// EvictTable drops every cached segment of the table.
+func (cache *BlockCache) EvictTable(table uuid.UUID) {
+	if cache == nil {
+		return
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	for element := cache.lru.Front(); element != nil; {
+		next := element.Next()
+		if element.Value.(*block).key.table == table {
+			cache.remove(element)
+		}
+		element = next
+	}
+	StorageStats.BlockCacheSize.Store(cache.size)
+}
+
+func (cache *BlockCache) remove(element *list.Element) {
+	b := cache.lru.Remove(element).(*block)
+	delete(cache.blocks, b.key)
+	cache.size -= b.size
+}
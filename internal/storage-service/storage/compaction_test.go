@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"github.com/google/uuid"
+	"reflect"
+	"testing"
+)
+
+// testTable is a table of the level holding the keys first to last in size
+// bytes. Pickers only look at the index and the metadata, so it has no file.
+func testTable(level int, first string, last string, size int64) SsTable {
+	return SsTable{id: uuid.New(), level: level, size: size, ind: SparseIndex{{key: first, lastKey: last}}, last: knownLastKey(last)}
+}
+
+func tableIDs(tables []SsTable) []uuid.UUID {
+	ids := make([]uuid.UUID, 0, len(tables))
+	for _, table := range tables {
+		ids = append(ids, table.id)
+	}
+	return ids
+}
+
+// A level is compacted once it outgrows its target: L0 by its table count,
+// level n by BaseLevelSize * LevelSizeMultiplier^(n-1) bytes. The compaction
+// takes the overlapping tables of the next level along.
+func TestLeveledPickCompaction(t *testing.T) {
+	l0a, l0b := testTable(0, "c", "k", 10), testTable(0, "a", "e", 10)
+	l1a, l1b, l1c := testTable(1, "a", "d", 60), testTable(1, "e", "h", 60), testTable(1, "m", "p", 60)
+	l2a, l2b, l2c := testTable(2, "a", "f", 200), testTable(2, "g", "n", 200), testTable(2, "o", "z", 200)
+	l3 := testTable(3, "a", "z", 5000)
+	apart0, apart1 := testTable(0, "a", "b", 10), testTable(0, "c", "d", 10)
+	tests := []struct {
+		name   string
+		tables []SsTable
+		// wantLevel is the level compacted into, zero for no compaction.
+		wantLevel  int
+		wantInputs []SsTable
+	}{
+		{"nothing to compact", []SsTable{l0a, l1a, l2a}, 0, nil},
+		{"level 0 reaches its trigger", []SsTable{l1a, l1b, l1c, l0b, l0a}, 1, []SsTable{l1a, l1b, l0b, l0a}},
+		{"level 0 without overlapping level 1 tables", []SsTable{l1c, apart0, apart1}, 1, []SsTable{apart0, apart1}},
+		{"level 1 over its target", []SsTable{l2a, l2b, l1a, l1b}, 2, []SsTable{l2a, l1a}},
+		{"level 2 over its target", []SsTable{l3, l2a, l2b, l2c, l1a}, 3, []SsTable{l3, l2a}},
+		{"the fullest level wins", []SsTable{l2a, l2b, l2c, testTable(2, "p", "q", 400), l1a, l1b}, 3, []SsTable{l2a}},
+		{"the last level never compacts", []SsTable{l3, testTable(3, "b", "c", 9000)}, 0, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			merger := &LeveledMerger{L0CompactionTrigger: 2, BaseLevelSize: 100, LevelSizeMultiplier: 4, MaxLevels: 4}
+			task := merger.pickCompaction(merger.groupByLevel(test.tables))
+			if test.wantLevel == 0 {
+				if task != nil {
+					t.Fatalf("picked a compaction into level %d", task.level)
+				}
+				return
+			}
+			if task == nil || task.level != test.wantLevel {
+				t.Fatalf("picked %+v, want a compaction into level %d", task, test.wantLevel)
+			}
+			if got, want := tableIDs(task.inputs), tableIDs(test.wantInputs); !reflect.DeepEqual(got, want) {
+				t.Fatalf("picked inputs %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// The tables of an oversized level are picked round-robin by key.
+func TestLeveledPickCompactionRoundRobin(t *testing.T) {
+	level1 := []SsTable{testTable(1, "a", "c", 100), testTable(1, "d", "f", 100), testTable(1, "g", "i", 100)}
+	merger := &LeveledMerger{L0CompactionTrigger: 4, BaseLevelSize: 100, LevelSizeMultiplier: 10, MaxLevels: 3}
+	levels := merger.groupByLevel([]SsTable{level1[2], level1[0], level1[1]})
+	for round, want := range []SsTable{level1[0], level1[1], level1[2], level1[0]} {
+		task := merger.pickCompaction(levels)
+		if task == nil || len(task.inputs) != 1 || task.inputs[0].id != want.id {
+			t.Fatalf("round %d picked %+v, want the table starting at %q", round, task, want.firstKey())
+		}
+	}
+}
+
+// Levels past MaxLevels are folded into the last one, the levels past 0 are
+// sorted by key.
+func TestLeveledGroupByLevel(t *testing.T) {
+	l0new, l0old := testTable(0, "x", "y", 1), testTable(0, "a", "b", 1)
+	l1b, l1a := testTable(1, "m", "n", 1), testTable(1, "a", "b", 1)
+	deep := testTable(5, "c", "d", 1)
+	l2 := testTable(2, "e", "f", 1)
+	merger := &LeveledMerger{MaxLevels: 3}
+	levels := merger.groupByLevel([]SsTable{l2, deep, l1b, l1a, l0old, l0new})
+	want := [][]SsTable{{l0old, l0new}, {l1a, l1b}, {deep, l2}}
+	for level := range want {
+		if got := tableIDs(levels[level]); !reflect.DeepEqual(got, tableIDs(want[level])) {
+			t.Fatalf("level %d holds %v, want %v", level, got, tableIDs(want[level]))
+		}
+	}
+	if got := tableIDs(flattenLevels(levels)); !reflect.DeepEqual(got, tableIDs([]SsTable{deep, l2, l1a, l1b, l0old, l0new})) {
+		t.Fatalf("flattened levels are %v", got)
+	}
+}
+
+// A tier is a run of adjacent tables of similar size. The run of the smallest
+// tables among those with MinThreshold tables is compacted, at most
+// MaxThreshold of them.
+func TestTieredPickBucket(t *testing.T) {
+	tests := []struct {
+		name         string
+		sizes        []int64
+		maxThreshold int
+		minTableSize int64
+		wantStart    int
+		wantEnd      int
+	}{
+		{"no tables", nil, 0, 0, 0, 0},
+		{"no tier is full", []int64{1000, 100, 10}, 0, 0, 0, 0},
+		{"one tier", []int64{100, 120, 90}, 0, 0, 0, 3},
+		{"the smallest tier wins", []int64{1000, 1100, 900, 100, 110}, 0, 0, 3, 5},
+		{"a larger tier past a table of another size", []int64{100, 1000, 1000, 1000}, 0, 0, 1, 4},
+		{"similar tables apart are no tier", []int64{100, 1000, 100, 1000}, 0, 0, 0, 0},
+		{"capped at MaxThreshold", []int64{100, 100, 100, 100, 100}, 3, 0, 0, 3},
+		{"tables under MinTableSize are similar", []int64{1, 40, 7, 1000}, 0, 50, 0, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tables := make([]SsTable, 0, len(test.sizes))
+			for _, size := range test.sizes {
+				tables = append(tables, testTable(0, "a", "z", size))
+			}
+			merger := &SizeTieredMerger{MinThreshold: 2, MaxThreshold: test.maxThreshold, BucketLow: 0.5, BucketHigh: 1.5, MinTableSize: test.minTableSize}
+			start, end := merger.pickBucket(tables)
+			if start != test.wantStart || end != test.wantEnd {
+				t.Fatalf("picked tables [%d, %d), want [%d, %d)", start, end, test.wantStart, test.wantEnd)
+			}
+		})
+	}
+}
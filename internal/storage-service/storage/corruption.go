@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"log"
+)
+
+// ErrCorruption reports ssTable, manifest or WAL data that fails its checksum
+// or cannot be decoded. Offset is the position of the damaged segment, index
+// block or record in the file at Path. Table is set for ssTables and their
+// index journals only.
+type ErrCorruption struct {
+	Table  uuid.UUID `json:"table"`
+	Path   string    `json:"path"`
+	Offset int64     `json:"offset"`
+	Reason string    `json:"reason"`
+}
+
+func (err *ErrCorruption) Error() string {
+	if err.Table == uuid.Nil {
+		return fmt.Sprintf("%s is corrupted at offset %d: %s", err.Path, err.Offset, err.Reason)
+	}
+	return fmt.Sprintf("ssTable %s is corrupted at offset %d: %s", err.Table, err.Offset, err.Reason)
+}
+
+// corruption logs and counts a corruption of the table and returns it as an
+// error.
+func (table *SsTable) corruption(offset int64, reason string) error {
+	return reportCorruption(&ErrCorruption{Table: table.id, Path: table.dPath, Offset: offset, Reason: reason})
+}
+
+// journalCorruption is corruption of the index journal of a table in the text
+// format.
+func (table *SsTable) journalCorruption(offset int64, reason string) error {
+	return reportCorruption(&ErrCorruption{Table: table.id, Path: table.jPath, Offset: offset, Reason: reason})
+}
+
+// fileCorruption logs and counts a corruption of the manifest or WAL file at
+// path and returns it as an error.
+func fileCorruption(path string, offset int64, reason string) error {
+	return reportCorruption(&ErrCorruption{Path: path, Offset: offset, Reason: reason})
+}
+
+func reportCorruption(err *ErrCorruption) error {
+	log.Printf("Corrupted file. Err: %s", err)
+	StorageStats.CorruptionErrors.Add(1)
+	return err
+}
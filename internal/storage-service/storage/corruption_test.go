@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"os"
+	"testing"
+)
+
+// fileDamage changes the data of a file. base is the offset of the record the
+// test damages, the helpers below count their offsets from it.
+type fileDamage func(data []byte, base int) []byte
+
+func intact() fileDamage {
+	return func(data []byte, base int) []byte { return data }
+}
+
+// cutAt keeps the data up to base+at.
+func cutAt(at int) fileDamage {
+	return func(data []byte, base int) []byte { return data[:base+at] }
+}
+
+// cutEnd drops the last n bytes.
+func cutEnd(n int) fileDamage {
+	return func(data []byte, base int) []byte { return data[:len(data)-n] }
+}
+
+// flipBits flips the bits of mask in the byte at base+at.
+func flipBits(at int, mask byte) fileDamage {
+	return func(data []byte, base int) []byte { data[base+at] ^= mask; return data }
+}
+
+// addTo adds delta to the byte at base+at, wrapping around.
+func addTo(at int, delta int) fileDamage {
+	return func(data []byte, base int) []byte { data[base+at] = byte(int(data[base+at]) + delta); return data }
+}
+
+func setTo(at int, value byte) fileDamage {
+	return func(data []byte, base int) []byte { data[base+at] = value; return data }
+}
+
+// zeroOut zeroes n bytes from base+at. An n that is not positive zeroes up to
+// -n bytes before the end.
+func zeroOut(at int, n int) fileDamage {
+	return func(data []byte, base int) []byte {
+		end := base + at + n
+		if n <= 0 {
+			end = len(data) + n
+		}
+		for i := base + at; i < end; i++ {
+			data[i] = 0
+		}
+		return data
+	}
+}
+
+func appendZeroes(n int) fileDamage {
+	return func(data []byte, base int) []byte { return append(data, make([]byte, n)...) }
+}
+
+// damageFile rewrites the file at path with the damage done at base and
+// returns the data written.
+func damageFile(t *testing.T, path string, damage fileDamage, base int) []byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = damage(data, base)
+	if err = os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
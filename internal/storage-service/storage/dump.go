@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"errors"
+	"github.com/google/uuid"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// TableInfo describes the layout of an ssTable file as InspectTable reads it.
+type TableInfo struct {
+	ID          string `json:"id"`
+	Path        string `json:"path"`
+	JournalPath string `json:"journal_path,omitempty"`
+	// Format is footerTableFormat for tables with an index footer and
+	// journalTableFormat for tables indexed by a journal file.
+	Format string `json:"format"`
+	// Codec is the codec the table was written with. Segments that did not
+	// shrink are stored uncompressed.
+	Codec            string        `json:"codec"`
+	FileSize         int64         `json:"file_size"`
+	CompressedSize   int64         `json:"compressed_size"`
+	UncompressedSize int64         `json:"uncompressed_size"`
+	Entries          int           `json:"entries"`
+	Tombstones       int           `json:"tombstones"`
+	FirstKey         string        `json:"first_key"`
+	LastKey          string        `json:"last_key"`
+	Segments         []SegmentInfo `json:"segments"`
+}
+
+// SegmentInfo is a sparse index entry and the segment it points to.
+type SegmentInfo struct {
+	FirstKey         string `json:"first_key"`
+	LastKey          string `json:"last_key,omitempty"`
+	Offset           int64  `json:"offset"`
+	CompressedSize   int64  `json:"compressed_size"`
+	UncompressedSize int64  `json:"uncompressed_size"`
+	Entries          int    `json:"entries"`
+	Codec            string `json:"codec"`
+	Checksum         uint32 `json:"checksum,omitempty"`
+}
+
+// tableFile is a table opened read-only by openTableFile, without a block
+// cache or a bloom filter.
+type tableFile struct {
+	SsTable
+	// layout is the TableInfo format of the table.
+	layout string
+}
+
+// openTableFile opens the table at path. journalPath is the index journal of
+// tables without an index footer.
+func openTableFile(path string, journalPath string) (tableFile, error) {
+	name := filepath.Base(path)
+	// Tables are named by their id, a copy may be named anyhow.
+	id, _ := uuid.Parse(strings.TrimSuffix(name, filepath.Ext(name)))
+	file := tableFile{SsTable: SsTable{dPath: path, jPath: journalPath, id: id}}
+	err := file.readIndexBlock()
+	switch {
+	case err == nil:
+		file.layout = footerTableFormat
+		return file, nil
+	case !errors.Is(err, errNoFooter):
+		return file, err
+	}
+	if _, err = os.Stat(journalPath); err != nil {
+		return file, errors.New("table has neither an index footer nor an index journal")
+	}
+	file.BuildSparseIndex()
+	file.layout = journalTableFormat
+	return file, file.corrupt
+}
+
+// InspectTable reads every segment of the table at path and describes them.
+// journalPath is the index journal of tables without an index footer.
+func InspectTable(path string, journalPath string) (TableInfo, error) {
+	file, err := openTableFile(path, journalPath)
+	info := TableInfo{ID: file.id.String(), Path: path, Format: file.layout, FileSize: fileSize(path), Segments: make([]SegmentInfo, 0)}
+	if err != nil {
+		return info, err
+	}
+	if file.layout == journalTableFormat {
+		info.JournalPath = journalPath
+	}
+	info.Codec = CodecGzip.String()
+	if file.codec != nil {
+		info.Codec = file.codec.ID().String()
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return info, err
+	}
+	for i, entry := range file.ind {
+		if err = file.checkSegmentBounds(entry); err != nil {
+			return info, err
+		}
+		entries, size, err := file.decodeSegment(entry, data[entry.start:entry.end])
+		if err != nil {
+			return info, err
+		}
+		info.Segments = append(info.Segments, SegmentInfo{FirstKey: entry.key, LastKey: entry.lastKey, Offset: entry.start, CompressedSize: entry.end - entry.start,
+			UncompressedSize: size, Entries: len(entries), Codec: entry.codec.String(), Checksum: entry.checksum})
+		info.CompressedSize += entry.end - entry.start
+		info.UncompressedSize += size
+		info.Entries += len(entries)
+		for _, keyValue := range entries {
+			if keyValue.Deleted {
+				info.Tombstones++
+			}
+		}
+		if len(entries) != 0 {
+			if i == 0 {
+				info.FirstKey = entries[0].Key
+			}
+			info.LastKey = entries[len(entries)-1].Key
+		}
+	}
+	return info, nil
+}
+
+// DumpTable returns the entries of the table at path in [start, end), every
+// version and tombstone included. An empty end means no upper bound.
+func DumpTable(path string, journalPath string, start string, end string) ([]KeyValue, error) {
+	file, err := openTableFile(path, journalPath)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]KeyValue, 0)
+	it := NewSsTableIterator(&file.SsTable)
+	defer it.Close()
+	for ok := it.Seek(start); ok && (end == "" || it.Key() < end); ok = it.Next() {
+		result = append(result, KeyValue{Key: it.Key(), Value: it.Value(), Deleted: it.Deleted(), Seq: it.Seq()})
+	}
+	return result, it.Err()
+}
@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"github.com/google/uuid"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const flushRetryDelay = time.Second
+
+// immutableMemTable is a full MemTable waiting to be written to an ssTable. It
+// is never modified, so it can be read and flushed without the write lock.
+type immutableMemTable struct {
+	memTable   MemTable
+	generation WalGeneration
+}
+
+// flushState is the background flush bookkeeping of a StorageImpl. The zero
+// value is ready to use.
+type flushState struct {
+	once sync.Once
+	// changed is signalled under the storage write lock whenever immutables
+	// grows or shrinks.
+	changed *sync.Cond
+	// immutables are ordered from oldest to newest.
+	immutables []immutableMemTable
+}
+
+func (storage *StorageImpl) flushCond() *sync.Cond {
+	storage.flusher.once.Do(func() {
+		storage.flusher.changed = sync.NewCond(&storage.Mutex)
+		go storage.flushImmutables()
+	})
+	return storage.flusher.changed
+}
+
+// flushPending reports whether writers have to wait for the flush. The caller
+// holds the read or the write lock.
+func (storage *StorageImpl) flushPending() bool {
+	return len(storage.flusher.immutables) >= storage.maxImmutableMemTables()
+}
+
+func (storage *StorageImpl) maxImmutableMemTables() int {
+	if storage.MaxImmutableMemTables < 1 {
+		return 1
+	}
+	return storage.MaxImmutableMemTables
+}
+
+// waitForFlush blocks writers while MaxImmutableMemTables memtables wait to be
+// flushed. The caller holds the write lock.
+func (storage *StorageImpl) waitForFlush() {
+	if !storage.flushPending() {
+		return
+	}
+	StorageStats.WriteStalls.Add(1)
+	for storage.flushPending() {
+		storage.flushCond().Wait()
+	}
+}
+
+// freeze turns the full MemTable into an immutable one and swaps in an empty
+// MemTable of the next journal generation. The caller holds the write lock.
+func (storage *StorageImpl) freeze() error {
+	generation, err := storage.Wal.NewGeneration()
+	if err != nil {
+		return err
+	}
+	log.Printf("Freeze MemTable of generation %d", generation.Number)
+	storage.flusher.immutables = append(storage.flusher.immutables, immutableMemTable{memTable: storage.MemTable, generation: generation})
+	storage.MemTable = storage.MemTable.NewEmpty()
+	StorageStats.ImmutableMemTables.Store(int64(len(storage.flusher.immutables)))
+	storage.flushCond().Broadcast()
+	return nil
+}
+
+// flushImmutables writes immutable memtables to ssTables, oldest first, and
+// drops the journal segments of a generation once its table is in the
+// manifest.
+func (storage *StorageImpl) flushImmutables() {
+	storage.Mutex.Lock()
+	defer storage.Mutex.Unlock()
+	for {
+		for len(storage.flusher.immutables) == 0 {
+			storage.flusher.changed.Wait()
+		}
+		immutable := storage.flusher.immutables[0]
+		// Snapshots taken later see the newest version of every flushed key.
+		snapshots := storage.liveSnapshots()
+
+		storage.Mutex.Unlock()
+		newTable, err := storage.writeSsTable(immutable.memTable, snapshots)
+		storage.Mutex.Lock()
+		if err == nil {
+			newTable.smallestSeq, newTable.largestSeq = immutable.generation.FirstSeq, immutable.generation.LastSeq
+			err = storage.Manifest.LogEdit(VersionEdit{Added: []TableMeta{newTable.meta()}, FlushedSeq: immutable.generation.LastSeq})
+		}
+		if err != nil {
+			log.Printf("Flush MemTable error. Err: %s", err)
+			if newTable.refs != nil {
+				newTable.unref()
+			}
+			storage.Mutex.Unlock()
+			time.Sleep(flushRetryDelay)
+			storage.Mutex.Lock()
+			continue
+		}
+		*storage.SsTables = append(*storage.SsTables, newTable)
+		storage.flusher.immutables = storage.flusher.immutables[1:]
+		StorageStats.ImmutableMemTables.Store(int64(len(storage.flusher.immutables)))
+		storage.flusher.changed.Broadcast()
+
+		storage.Mutex.Unlock()
+		if err = storage.Wal.RemoveGeneration(immutable.generation.Number); err != nil {
+			log.Printf("error occuring while deleting journal. Err: %s", err)
+		}
+		storage.Mutex.Lock()
+	}
+}
+
+// writeSsTable writes the memtable to a new durable ssTable, keeping the
+// versions the snapshots read.
+func (storage *StorageImpl) writeSsTable(memTable MemTable, snapshots []uint64) (SsTable, error) {
+	log.Printf("Copy MemTable to the ssTable")
+	var id = uuid.New()
+	filePath := filepath.Join(storage.SsTableDir, id.String())
+	var newTable = SsTable{dPath: filePath + ".gz", bPath: filePath + ".bloom", segLen: storage.SsTableSegmentLength,
+		id: id, bloomBitsPerKey: storage.BloomBitsPerKey, cache: storage.BlockCache, codec: storage.Compression.ForLevel(0)}
+	if err := newTable.Init(memTable, snapshots); err != nil {
+		return SsTable{}, err
+	}
+	// The table file is synced by Init, its directory entry is not.
+	if err := syncDir(storage.SsTableDir); err != nil {
+		return SsTable{}, err
+	}
+	return newTable, nil
+}
@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"sort"
+)
+
+// Table files end with an index block and a fixed size footer:
+//
+//	segments | index block | index offset (8) | index length (4) | index CRC32-C (4) | magic (8)
+//
+// The index block starts with the codec the table was written with and holds
+// the sparse index entries in key order, each with the first and the last key,
+// the offset, the end, the CRC32-C and the codec of its segment.
+const footerSize = 24
+
+// Formats of ssTable files as TableInfo reports them.
+const (
+	footerTableFormat  = "v5"
+	journalTableFormat = "journal"
+)
+
+var (
+	tableMagic = []byte("PHSST\x00\x00\x05")
+
+	errNoFooter = errors.New("ssTable has no index footer")
+)
+
+// IndexEntry maps the first key of a segment to the segment location.
+type IndexEntry struct {
+	key string
+	// lastKey is empty in tables of the text format.
+	lastKey string
+	SparseIndices
+	checksum uint32
+	codec    CodecID
+}
+
+// SparseIndex is sorted by key.
+type SparseIndex []IndexEntry
+
+// Search returns the position of the segment that may hold the key, that is the
+// entry with the greatest key not above it, or -1 if the key precedes the table.
+func (index SparseIndex) Search(key string) int {
+	return sort.Search(len(index), func(i int) bool {
+		return index[i].key > key
+	}) - 1
+}
+
+func (index SparseIndex) appendTo(buf []byte) []byte {
+	for _, entry := range index {
+		buf = binary.AppendUvarint(buf, uint64(len(entry.key)))
+		buf = append(buf, entry.key...)
+		buf = binary.AppendUvarint(buf, uint64(len(entry.lastKey)))
+		buf = append(buf, entry.lastKey...)
+		buf = binary.AppendUvarint(buf, uint64(entry.start))
+		buf = binary.AppendUvarint(buf, uint64(entry.end))
+		buf = binary.LittleEndian.AppendUint32(buf, entry.checksum)
+		buf = append(buf, byte(entry.codec))
+	}
+	return buf
+}
+
+// decodeSparseIndex reads the entries of an index block.
+func decodeSparseIndex(data []byte) (SparseIndex, error) {
+	index := make(SparseIndex, 0)
+	for len(data) != 0 {
+		key, n := readBytes(data)
+		if n <= 0 {
+			return index, errBrokenRecord
+		}
+		data = data[n:]
+		lastKey, n := readBytes(data)
+		if n <= 0 {
+			return index, errBrokenRecord
+		}
+		data = data[n:]
+		start, n := binary.Uvarint(data)
+		if n <= 0 {
+			return index, errBrokenRecord
+		}
+		data = data[n:]
+		end, n := binary.Uvarint(data)
+		if n <= 0 {
+			return index, errBrokenRecord
+		}
+		data = data[n:]
+		if len(data) < 5 {
+			return index, errBrokenRecord
+		}
+		index = append(index, IndexEntry{key: string(key), lastKey: string(lastKey), SparseIndices: SparseIndices{int64(start), int64(end)},
+			checksum: binary.LittleEndian.Uint32(data), codec: CodecID(data[4])})
+		data = data[5:]
+	}
+	return index, nil
+}
+
+// sparseIndexFromMap sorts a sparse index read from a legacy journal file.
+func sparseIndexFromMap(indexMap map[string]SparseIndices) SparseIndex {
+	index := make(SparseIndex, 0, len(indexMap))
+	for key, indices := range indexMap {
+		index = append(index, IndexEntry{key: key, SparseIndices: indices})
+	}
+	sort.Slice(index, func(i, j int) bool {
+		return index[i].key < index[j].key
+	})
+	return index
+}
+
+// indexBlock returns the index block and the footer of a table whose segments
+// end at indexOffset.
+func (table *SsTable) indexBlock(indexOffset int64) []byte {
+	data := table.ind.appendTo([]byte{byte(table.codec.ID())})
+	indexLength := len(data)
+	indexChecksum := crc32.Checksum(data, crcTable)
+	data = binary.LittleEndian.AppendUint64(data, uint64(indexOffset))
+	data = binary.LittleEndian.AppendUint32(data, uint32(indexLength))
+	data = binary.LittleEndian.AppendUint32(data, indexChecksum)
+	return append(data, tableMagic...)
+}
+
+// readIndexBlock loads the sparse index from the table file footer. A damaged
+// index block is reported as ErrCorruption.
+func (table *SsTable) readIndexBlock() error {
+	file, err := os.Open(table.dPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < footerSize {
+		return errNoFooter
+	}
+	footer := make([]byte, footerSize)
+	if _, err = file.ReadAt(footer, info.Size()-footerSize); err != nil {
+		return err
+	}
+	if !bytes.Equal(footer[16:], tableMagic) {
+		return errNoFooter
+	}
+	indexOffset := int64(binary.LittleEndian.Uint64(footer[0:8]))
+	indexLength := int64(binary.LittleEndian.Uint32(footer[8:12]))
+	if indexOffset < 0 || indexOffset+indexLength > info.Size()-footerSize {
+		return table.corruption(info.Size()-footerSize, "index footer points outside the table")
+	}
+	data := make([]byte, indexLength)
+	if _, err = file.ReadAt(data, indexOffset); err != nil {
+		return err
+	}
+	table.segmentsEnd = indexOffset
+	table.format = seqRecordSegmentFormat
+	if crc32.Checksum(data, crcTable) != binary.LittleEndian.Uint32(footer[12:16]) {
+		return table.corruption(indexOffset, "index checksum mismatch")
+	}
+	if len(data) < 1 {
+		return table.corruption(indexOffset, errBrokenRecord.Error())
+	}
+	if table.codec, err = NewCodec(CodecID(data[0]), DefaultLevel); err != nil {
+		return table.corruption(indexOffset, err.Error())
+	}
+	if table.ind, err = decodeSparseIndex(data[1:]); err != nil {
+		return table.corruption(indexOffset, err.Error())
+	}
+	return nil
+}
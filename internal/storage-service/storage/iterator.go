@@ -0,0 +1,235 @@
+package storage
+
+import "container/heap"
+
+// Iterator walks entries in ascending key order, the versions of a key newest
+// first. Seek positions it at the newest version of the first key not less
+// than the given one and Next moves to the following entry; both report
+// whether the iterator points at an entry. Tombstones are returned as entries
+// with Deleted set. Err reports the error that stopped iteration.
+//
+//	for ok := it.Seek(start); ok; ok = it.Next() {
+//		...
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type Iterator interface {
+	Seek(key string) bool
+	Next() bool
+	Key() string
+	Value() string
+	Deleted() bool
+	// Seq is the sequence number of the write, zero for entries written
+	// before writes were numbered.
+	Seq() uint64
+	Err() error
+	Close() error
+}
+
+// NewMemTableIterator returns an iterator over the MemTable.
+func NewMemTableIterator(memTable MemTable) Iterator {
+	return memTable.NewIterator()
+}
+
+type ssTableIterator struct {
+	table   *SsTable
+	segment int
+	entries []KeyValue
+	pos     int
+	err     error
+}
+
+// NewSsTableIterator returns an iterator over the table. Segments are read and
+// decompressed one at a time as the iterator reaches them.
+func NewSsTableIterator(table *SsTable) Iterator {
+	return &ssTableIterator{table: table}
+}
+
+func (it *ssTableIterator) Seek(key string) bool {
+	it.err = it.table.corrupt
+	if it.err != nil {
+		return false
+	}
+	segment := it.table.ind.Search(key)
+	if segment < 0 {
+		segment = 0
+	}
+	if !it.load(segment) {
+		return false
+	}
+	for it.valid() && it.entries[it.pos].Key < key {
+		it.pos++
+	}
+	return it.skipExhausted()
+}
+
+func (it *ssTableIterator) Next() bool {
+	if !it.valid() {
+		return false
+	}
+	it.pos++
+	return it.skipExhausted()
+}
+
+func (it *ssTableIterator) load(segment int) bool {
+	it.segment, it.entries, it.pos = segment, nil, 0
+	if segment >= len(it.table.ind) {
+		return false
+	}
+	it.entries, it.err = it.table.readSegment(segment)
+	return it.err == nil
+}
+
+func (it *ssTableIterator) skipExhausted() bool {
+	for it.err == nil && it.segment < len(it.table.ind) && it.pos == len(it.entries) {
+		it.load(it.segment + 1)
+	}
+	return it.valid()
+}
+
+func (it *ssTableIterator) valid() bool {
+	return it.err == nil && it.pos < len(it.entries)
+}
+
+func (it *ssTableIterator) Key() string   { return it.entries[it.pos].Key }
+func (it *ssTableIterator) Value() string { return it.entries[it.pos].Value }
+func (it *ssTableIterator) Deleted() bool { return it.entries[it.pos].Deleted }
+func (it *ssTableIterator) Seq() uint64   { return it.entries[it.pos].Seq }
+func (it *ssTableIterator) Err() error    { return it.err }
+
+func (it *ssTableIterator) Close() error {
+	it.entries = nil
+	return nil
+}
+
+// mergingIterator merges iterators ordered from newest to oldest. Every version
+// of a key is returned, those of newer iterators first, so the versions of a
+// key stay ordered newest first.
+type mergingIterator struct {
+	iterators []Iterator
+	heap      iteratorHeap
+	err       error
+}
+
+func NewMergingIterator(iterators []Iterator) Iterator {
+	return &mergingIterator{iterators: iterators}
+}
+
+func (it *mergingIterator) Seek(key string) bool {
+	it.heap = it.heap[:0]
+	it.err = nil
+	for i, iterator := range it.iterators {
+		if iterator.Seek(key) {
+			it.heap = append(it.heap, heapItem{iterator: iterator, priority: i})
+		} else if err := iterator.Err(); err != nil {
+			it.err = err
+		}
+	}
+	heap.Init(&it.heap)
+	return it.valid()
+}
+
+func (it *mergingIterator) Next() bool {
+	if !it.valid() {
+		return false
+	}
+	if it.heap[0].iterator.Next() {
+		heap.Fix(&it.heap, 0)
+		return it.valid()
+	}
+	if err := it.heap[0].iterator.Err(); err != nil {
+		it.err = err
+	}
+	heap.Pop(&it.heap)
+	return it.valid()
+}
+
+func (it *mergingIterator) valid() bool {
+	return it.err == nil && len(it.heap) != 0
+}
+
+func (it *mergingIterator) Key() string   { return it.heap[0].iterator.Key() }
+func (it *mergingIterator) Value() string { return it.heap[0].iterator.Value() }
+func (it *mergingIterator) Deleted() bool { return it.heap[0].iterator.Deleted() }
+func (it *mergingIterator) Seq() uint64   { return it.heap[0].iterator.Seq() }
+func (it *mergingIterator) Err() error    { return it.err }
+
+func (it *mergingIterator) Close() error {
+	var err error
+	for _, iterator := range it.iterators {
+		if closeErr := iterator.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// snapshotIterator returns of every key of the wrapped iterator the newest
+// version with a sequence number not above seq, as a reader of the snapshot
+// taken at seq sees it.
+type snapshotIterator struct {
+	it  Iterator
+	seq uint64
+}
+
+// NewSnapshotIterator returns the view of it at seq, MaxSeq for the latest
+// version of every key.
+func NewSnapshotIterator(it Iterator, seq uint64) Iterator {
+	return &snapshotIterator{it: it, seq: seq}
+}
+
+func (it *snapshotIterator) Seek(key string) bool {
+	return it.visible(it.it.Seek(key))
+}
+
+func (it *snapshotIterator) Next() bool {
+	key := it.it.Key()
+	ok := it.it.Next()
+	for ok && it.it.Key() == key {
+		ok = it.it.Next()
+	}
+	return it.visible(ok)
+}
+
+// visible skips the versions written after the snapshot.
+func (it *snapshotIterator) visible(ok bool) bool {
+	for ok && it.it.Seq() > it.seq {
+		ok = it.it.Next()
+	}
+	return ok
+}
+
+func (it *snapshotIterator) Key() string   { return it.it.Key() }
+func (it *snapshotIterator) Value() string { return it.it.Value() }
+func (it *snapshotIterator) Deleted() bool { return it.it.Deleted() }
+func (it *snapshotIterator) Seq() uint64   { return it.it.Seq() }
+func (it *snapshotIterator) Err() error    { return it.it.Err() }
+func (it *snapshotIterator) Close() error  { return it.it.Close() }
+
+type heapItem struct {
+	iterator Iterator
+	priority int
+}
+
+type iteratorHeap []heapItem
+
+func (h iteratorHeap) Len() int { return len(h) }
+
+func (h iteratorHeap) Less(i, j int) bool {
+	if h[i].iterator.Key() != h[j].iterator.Key() {
+		return h[i].iterator.Key() < h[j].iterator.Key()
+	}
+	return h[i].priority < h[j].priority
+}
+
+func (h iteratorHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *iteratorHeap) Push(x any) { *h = append(*h, x.(heapItem)) }
+
+func (h *iteratorHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
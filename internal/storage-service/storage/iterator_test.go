@@ -0,0 +1,255 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// writeTestTable writes the entries, sorted by key and newest version first,
+// to a table with a bloom filter in dir.
+func writeTestTable(t *testing.T, dir string, segLen int64, keyValues []KeyValue) *SsTable {
+	t.Helper()
+	id := uuid.New()
+	basePath := filepath.Join(dir, id.String())
+	table := &SsTable{dPath: basePath + ".gz", bPath: basePath + ".bloom", segLen: segLen, id: id, bloomBitsPerKey: 10}
+	if err := table.InitFromSlice(keyValues); err != nil {
+		t.Fatal(err)
+	}
+	return table
+}
+
+// testMemTable returns a MemTable holding the entries, written in the order of
+// their sequence numbers.
+func testMemTable(t *testing.T, keyValues ...KeyValue) MemTable {
+	t.Helper()
+	writes := append([]KeyValue{}, keyValues...)
+	sort.SliceStable(writes, func(i, j int) bool { return writes[i].Seq < writes[j].Seq })
+	memTable := NewSkipListMemTable(1 << 20)
+	for _, keyValue := range writes {
+		var err error
+		if keyValue.Deleted {
+			err = memTable.Delete(keyValue.Key, keyValue.Seq)
+		} else {
+			err = memTable.Add(keyValue.Key, keyValue.Value, keyValue.Seq)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return memTable
+}
+
+// collect returns the entries of the iterator from start on.
+func collect(t *testing.T, it Iterator, start string) []KeyValue {
+	t.Helper()
+	result := make([]KeyValue, 0)
+	for ok := it.Seek(start); ok; ok = it.Next() {
+		result = append(result, KeyValue{Key: it.Key(), Value: it.Value(), Deleted: it.Deleted(), Seq: it.Seq()})
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+// A table iterator seeks into any segment and walks across segments, every
+// version and tombstone included.
+func TestSsTableIterator(t *testing.T) {
+	keyValues := make([]KeyValue, 0)
+	for i := 0; i < 40; i++ {
+		key := fmt.Sprintf("key%02d", i*2)
+		switch {
+		case i%7 == 0:
+			keyValues = append(keyValues, KeyValue{Key: key, Deleted: true, Seq: uint64(100 + i)})
+		case i%5 == 0:
+			keyValues = append(keyValues, KeyValue{Key: key, Value: "new", Seq: uint64(100 + i)}, KeyValue{Key: key, Value: "old", Seq: uint64(i + 1)})
+		default:
+			keyValues = append(keyValues, KeyValue{Key: key, Value: "value" + key, Seq: uint64(i + 1)})
+		}
+	}
+	table := writeTestTable(t, t.TempDir(), 100, keyValues)
+	if len(table.ind) < 5 {
+		t.Fatalf("table has %d segments, the test needs several", len(table.ind))
+	}
+	tests := []struct {
+		name  string
+		start string
+	}{
+		{"from the start", ""},
+		{"at the first key", "key00"},
+		{"at a key with two versions", "key10"},
+		{"between keys", "key31"},
+		{"at the first key of a segment", table.ind[2].key},
+		{"after the last key of a segment", table.ind[3].lastKey + "~"},
+		{"at the last key", "key78"},
+		{"past the last key", "key79"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			want := make([]KeyValue, 0)
+			for _, keyValue := range keyValues {
+				if keyValue.Key >= test.start {
+					want = append(want, keyValue)
+				}
+			}
+			if got := collect(t, NewSsTableIterator(table), test.start); !reflect.DeepEqual(got, want) {
+				t.Fatalf("iterated %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+// A damaged segment stops the iteration with ErrCorruption after the entries
+// of the segments before it.
+func TestSsTableIteratorOfCorruptSegment(t *testing.T) {
+	keyValues := make([]KeyValue, 0)
+	for i := 0; i < 40; i++ {
+		keyValues = append(keyValues, KeyValue{Key: fmt.Sprintf("key%02d", i), Value: "value", Seq: uint64(i + 1)})
+	}
+	table := writeTestTable(t, t.TempDir(), 100, keyValues)
+	damaged := table.ind[2]
+	data, err := os.ReadFile(table.dPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[damaged.start+1] ^= 0x01
+	if err = os.WriteFile(table.dPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	it := NewSsTableIterator(table)
+	count := 0
+	for ok := it.Seek(""); ok; ok = it.Next() {
+		if it.Key() >= damaged.key {
+			t.Fatalf("iterated key %q of the damaged segment", it.Key())
+		}
+		count++
+	}
+	var corruption *ErrCorruption
+	if !errors.As(it.Err(), &corruption) || corruption.Offset != damaged.start {
+		t.Fatalf("iteration stopped with %v, want corruption at offset %d", it.Err(), damaged.start)
+	}
+	if count == 0 {
+		t.Fatal("iteration stopped before the damaged segment")
+	}
+}
+
+// The merging iterator returns every version of every source in key order. The
+// versions of a key in newer sources come first, so a tombstone in a newer
+// source shadows the values of the older ones.
+func TestMergingIterator(t *testing.T) {
+	tests := []struct {
+		name string
+		// sources are ordered from newest to oldest.
+		sources [][]KeyValue
+		start   string
+		want    []KeyValue
+	}{
+		{"disjoint sources", [][]KeyValue{
+			{{Key: "b", Value: "2", Seq: 4}, {Key: "d", Value: "4", Seq: 5}},
+			{{Key: "a", Value: "1", Seq: 1}, {Key: "c", Value: "3", Seq: 2}, {Key: "e", Value: "5", Seq: 3}},
+		}, "", []KeyValue{
+			{Key: "a", Value: "1", Seq: 1}, {Key: "b", Value: "2", Seq: 4}, {Key: "c", Value: "3", Seq: 2},
+			{Key: "d", Value: "4", Seq: 5}, {Key: "e", Value: "5", Seq: 3},
+		}},
+		{"newest source first", [][]KeyValue{
+			{{Key: "a", Value: "new", Seq: 7}},
+			{{Key: "a", Value: "mid", Seq: 4}},
+			{{Key: "a", Value: "old", Seq: 1}, {Key: "b", Value: "1", Seq: 2}},
+		}, "", []KeyValue{
+			{Key: "a", Value: "new", Seq: 7}, {Key: "a", Value: "mid", Seq: 4}, {Key: "a", Value: "old", Seq: 1},
+			{Key: "b", Value: "1", Seq: 2},
+		}},
+		{"tombstone shadows older values", [][]KeyValue{
+			{{Key: "a", Deleted: true, Seq: 9}},
+			{{Key: "a", Value: "old", Seq: 3}, {Key: "b", Value: "1", Seq: 4}},
+		}, "", []KeyValue{
+			{Key: "a", Deleted: true, Seq: 9}, {Key: "a", Value: "old", Seq: 3}, {Key: "b", Value: "1", Seq: 4},
+		}},
+		{"value over an older tombstone", [][]KeyValue{
+			{{Key: "a", Value: "again", Seq: 9}},
+			{{Key: "a", Deleted: true, Seq: 5}},
+			{{Key: "a", Value: "first", Seq: 1}},
+		}, "", []KeyValue{
+			{Key: "a", Value: "again", Seq: 9}, {Key: "a", Deleted: true, Seq: 5}, {Key: "a", Value: "first", Seq: 1},
+		}},
+		{"seek past some sources", [][]KeyValue{
+			{{Key: "a", Value: "1", Seq: 3}},
+			{{Key: "c", Value: "3", Seq: 2}, {Key: "d", Value: "4", Seq: 1}},
+		}, "b", []KeyValue{
+			{Key: "c", Value: "3", Seq: 2}, {Key: "d", Value: "4", Seq: 1},
+		}},
+		{"empty sources", [][]KeyValue{{}, {{Key: "a", Value: "1", Seq: 1}}, {}}, "", []KeyValue{{Key: "a", Value: "1", Seq: 1}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			// The newest source is a MemTable, the older ones are tables.
+			iterators := make([]Iterator, 0, len(test.sources))
+			for i, source := range test.sources {
+				if i == 0 {
+					iterators = append(iterators, testMemTable(t, source...).NewIterator())
+				} else {
+					iterators = append(iterators, NewSsTableIterator(writeTestTable(t, dir, 100, source)))
+				}
+			}
+			it := NewMergingIterator(iterators)
+			defer it.Close()
+			if got := collect(t, it, test.start); !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("merged %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+// A snapshot iterator returns of every key the newest version not newer than
+// the snapshot, tombstones included, and skips keys written after it.
+func TestSnapshotIterator(t *testing.T) {
+	versions := []KeyValue{
+		{Key: "a", Value: "a3", Seq: 30}, {Key: "a", Value: "a2", Seq: 20}, {Key: "a", Value: "a1", Seq: 10},
+		{Key: "b", Deleted: true, Seq: 25}, {Key: "b", Value: "b1", Seq: 15},
+		{Key: "c", Value: "c1", Seq: 35},
+		{Key: "d", Value: "d2", Seq: 22}, {Key: "d", Deleted: true, Seq: 12}, {Key: "d", Value: "d0", Seq: 5},
+	}
+	tests := []struct {
+		name  string
+		seq   uint64
+		start string
+		want  []KeyValue
+	}{
+		{"latest", MaxSeq, "", []KeyValue{
+			{Key: "a", Value: "a3", Seq: 30}, {Key: "b", Deleted: true, Seq: 25}, {Key: "c", Value: "c1", Seq: 35}, {Key: "d", Value: "d2", Seq: 22},
+		}},
+		{"between versions", 21, "", []KeyValue{
+			{Key: "a", Value: "a2", Seq: 20}, {Key: "b", Value: "b1", Seq: 15}, {Key: "d", Deleted: true, Seq: 12},
+		}},
+		{"at a version", 25, "", []KeyValue{
+			{Key: "a", Value: "a2", Seq: 20}, {Key: "b", Deleted: true, Seq: 25}, {Key: "d", Value: "d2", Seq: 22},
+		}},
+		{"before most writes", 9, "", []KeyValue{{Key: "d", Value: "d0", Seq: 5}}},
+		{"before every write", 1, "", []KeyValue{}},
+		{"seek to a key with only newer versions", 21, "c", []KeyValue{{Key: "d", Deleted: true, Seq: 12}}},
+		{"seek between keys", MaxSeq, "bb", []KeyValue{{Key: "c", Value: "c1", Seq: 35}, {Key: "d", Value: "d2", Seq: 22}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, source := range []struct {
+				name string
+				it   func() Iterator
+			}{
+				{"memTable", func() Iterator { return testMemTable(t, versions...).NewIterator() }},
+				{"ssTable", func() Iterator { return NewSsTableIterator(writeTestTable(t, t.TempDir(), 40, versions)) }},
+			} {
+				if got := collect(t, NewSnapshotIterator(source.it(), test.seq), test.start); !reflect.DeepEqual(got, test.want) {
+					t.Fatalf("%s snapshot at %d read %+v, want %+v", source.name, test.seq, got, test.want)
+				}
+			}
+		})
+	}
+}
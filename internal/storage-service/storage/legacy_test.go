@@ -0,0 +1,219 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testdata/baseline holds a table written by the first table writer: 30 keys
+// in gzip chunks of 48 bytes, stored in map order, and a text index journal of
+// key:start:length lines.
+const baselineDir = "testdata/baseline"
+
+var baselineTableID = uuid.MustParse("00000000-0000-4000-8000-000000000001")
+
+func baselineValue(i int) string {
+	return fmt.Sprintf("value-%d", i*i)
+}
+
+func openBaselineTable(t *testing.T) SsTable {
+	t.Helper()
+	tables := OpenTables(baselineDir, Version{Tables: []TableMeta{{ID: baselineTableID}}}, NewBlockCache(1<<20))
+	if len(tables) != 1 {
+		t.Fatalf("OpenTables returned %d tables, want 1", len(tables))
+	}
+	if tables[0].corrupt != nil {
+		t.Fatalf("baseline table is corrupt: %s", tables[0].corrupt)
+	}
+	return tables[0]
+}
+
+func TestBaselineTableFind(t *testing.T) {
+	table := openBaselineTable(t)
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		value, err := table.Find(key, MaxSeq)
+		if err != nil || value != baselineValue(i) {
+			t.Errorf("Find(%q) = %q, %v, want %q", key, value, err, baselineValue(i))
+		}
+	}
+	for _, key := range []string{"key", "key30", "a", "key05x"} {
+		if value, err := table.Find(key, MaxSeq); err == nil {
+			t.Errorf("Find(%q) = %q, want not found", key, value)
+		}
+	}
+}
+
+func TestBaselineTableIterator(t *testing.T) {
+	table := openBaselineTable(t)
+	it := NewSsTableIterator(&table)
+	defer it.Close()
+	i := 0
+	for ok := it.Seek(""); ok; ok = it.Next() {
+		key := fmt.Sprintf("key%02d", i)
+		if it.Key() != key || it.Value() != baselineValue(i) || it.Deleted() {
+			t.Fatalf("entry %d is %q=%q, want %q=%q", i, it.Key(), it.Value(), key, baselineValue(i))
+		}
+		i++
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if i != 30 {
+		t.Fatalf("iterated %d entries, want 30", i)
+	}
+}
+
+func TestBaselineTableDump(t *testing.T) {
+	path := filepath.Join(baselineDir, baselineTableID.String()+".gz")
+	journalPath := filepath.Join(baselineDir, "journal", baselineTableID.String()+".bin")
+	info, err := InspectTable(path, journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Format != journalTableFormat || info.Entries != 30 || info.FirstKey != "key00" || info.LastKey != "key29" {
+		t.Fatalf("InspectTable = %+v", info)
+	}
+	keyValues, err := DumpTable(path, journalPath, "key10", "key20")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keyValues) != 10 || keyValues[0].Key != "key10" || keyValues[9].Value != baselineValue(19) {
+		t.Fatalf("DumpTable = %+v", keyValues)
+	}
+}
+
+func TestBaselineTableLastKey(t *testing.T) {
+	table := openBaselineTable(t)
+	if table.last == nil || table.last.loaded {
+		t.Fatal("the last key of a table without last keys in its index is read on open")
+	}
+	if lastKey := table.lastKey(); lastKey != "key29" {
+		t.Fatalf("lastKey() = %q, want key29", lastKey)
+	}
+}
+
+// writeJournalTable copies the baseline table into a new directory with the
+// given index journal and returns the directory.
+func writeJournalTable(t *testing.T, journal string) string {
+	t.Helper()
+	dir := t.TempDir()
+	name := baselineTableID.String()
+	data, err := os.ReadFile(filepath.Join(baselineDir, name+".gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, name+".gz"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.MkdirAll(filepath.Join(dir, "journal"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, "journal", name+".bin"), []byte(journal), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// Opening a table reads its index only, so a table whose segments cannot be
+// read still opens.
+func TestOpenTableWithBrokenJournal(t *testing.T) {
+	dir := writeJournalTable(t, "key00:657:-700\n")
+	tables := OpenTables(dir, Version{Tables: []TableMeta{{ID: baselineTableID}}}, nil)
+	if len(tables) != 1 {
+		t.Fatalf("OpenTables returned %d tables, want 1", len(tables))
+	}
+}
+
+// An index entry pointing outside the table is reported as corruption by
+// every reader of the segment.
+func TestSegmentOutsideTable(t *testing.T) {
+	tests := []struct {
+		name    string
+		journal string
+	}{
+		{"end before start", "key00:657:-700\n"},
+		{"negative start", "key00:-5:100\n"},
+		{"past the end of the file", "key00:0:100000\n"},
+	}
+	isCorruption := func(err error) bool {
+		var corruption *ErrCorruption
+		return errors.As(err, &corruption)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := writeJournalTable(t, test.journal)
+			name := baselineTableID.String()
+			path, journalPath := filepath.Join(dir, name+".gz"), filepath.Join(dir, "journal", name+".bin")
+
+			table := Restore(path, journalPath, NewBlockCache(1<<20))
+			if _, err := table.Find("key00", MaxSeq); !isCorruption(err) {
+				t.Errorf("Find error is %v, want corruption", err)
+			}
+			if _, err := DumpTable(path, journalPath, "", ""); !isCorruption(err) {
+				t.Errorf("DumpTable error is %v, want corruption", err)
+			}
+			if _, err := InspectTable(path, journalPath); !isCorruption(err) {
+				t.Errorf("InspectTable error is %v, want corruption", err)
+			}
+		})
+	}
+}
+
+// A malformed line of a text index journal makes the table corrupt instead of
+// failing the readers.
+func TestMalformedIndexJournal(t *testing.T) {
+	tests := []struct {
+		name    string
+		journal string
+	}{
+		{"missing length", "key00:0\n"},
+		{"key alone", "key00\n"},
+		{"start is no number", "key00:zero:657\n"},
+		{"length is no number", "key00:0:657b\n"},
+		{"second line malformed", "key00:0:657\nkey10:\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := writeJournalTable(t, test.journal)
+			name := baselineTableID.String()
+			path, journalPath := filepath.Join(dir, name+".gz"), filepath.Join(dir, "journal", name+".bin")
+
+			tables := OpenTables(dir, Version{Tables: []TableMeta{{ID: baselineTableID}}}, nil)
+			var corruption *ErrCorruption
+			if len(tables) != 1 || !errors.As(tables[0].corrupt, &corruption) || corruption.Path != journalPath {
+				t.Fatalf("opened tables %+v, want one corrupt table", tables)
+			}
+			if _, err := tables[0].Find("key00", MaxSeq); !errors.As(err, &corruption) {
+				t.Errorf("Find error is %v, want corruption", err)
+			}
+			if _, err := InspectTable(path, journalPath); !errors.As(err, &corruption) {
+				t.Errorf("InspectTable error is %v, want corruption", err)
+			}
+			if _, err := DumpTable(path, journalPath, "", ""); !errors.As(err, &corruption) {
+				t.Errorf("DumpTable error is %v, want corruption", err)
+			}
+			if report := Verify(dir, t.TempDir()); report.OK {
+				t.Errorf("Verify reports a table with a malformed journal as OK: %+v", report)
+			}
+		})
+	}
+}
+
+// Keys of the text format may hold colons, the start and the length are the
+// last two fields of an index journal line.
+func TestIndexJournalKeyWithColons(t *testing.T) {
+	table := SsTable{id: baselineTableID}
+	index, err := table.readTextJournal([]byte("a:b:c:10:20\nd:30:5\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := SparseIndex{{key: "a:b:c", SparseIndices: SparseIndices{10, 30}}, {key: "d", SparseIndices: SparseIndices{30, 35}}}
+	if len(index) != 2 || index[0] != want[0] || index[1] != want[1] {
+		t.Fatalf("index is %+v, want %+v", index, want)
+	}
+}
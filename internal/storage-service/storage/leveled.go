@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"github.com/google/uuid"
+	"log"
+	"sort"
+	"time"
+)
+
+// LeveledMerger compacts ssTables into levels. Level 0 holds flushed MemTables
+// that may overlap each other. Every deeper level holds tables with disjoint key
+// ranges and may grow up to BaseLevelSize * LevelSizeMultiplier^(level-1) bytes.
+// A compaction merges either every level 0 table or one table of an oversized
+// level with the overlapping tables of the next level only.
+//
+// The merged ssTables slice is kept ordered from oldest to newest: the deepest
+// level first, level 0 last, so that readers scanning it backwards see newer
+// values first.
+type LeveledMerger struct {
+	MergerImpl
+	L0CompactionTrigger int
+	BaseLevelSize       int64
+	LevelSizeMultiplier int64
+	MaxLevels           int
+	// compactPointers holds the last key compacted in every level, so tables of
+	// a level are picked round-robin.
+	compactPointers map[int]string
+}
+
+type compaction struct {
+	level  int
+	inputs []SsTable
+}
+
+func (merger *LeveledMerger) MergeAndCompaction(ssTables []SsTable, snapshots []uint64, newSsTables chan<- []SsTable) {
+	merger.Mutex.Lock()
+	defer merger.Mutex.Unlock()
+	levels := merger.groupByLevel(ssTables)
+	task := merger.pickCompaction(levels)
+	if task == nil {
+		newSsTables <- ssTables
+		return
+	}
+	first, last := keyRange(task.inputs)
+	dropTombstones := true
+	for level := task.level + 1; level < len(levels); level++ {
+		for _, table := range levels[level] {
+			if table.overlaps(first, last) {
+				dropTombstones = false
+			}
+		}
+	}
+	log.Printf("Compact %d ssTables into level %d", len(task.inputs), task.level)
+	started := time.Now()
+	outputs, err := merger.merge(task.inputs, snapshots, dropTombstones, merger.MemNewFileLimit, task.level)
+	if err != nil {
+		log.Printf("Merge ssTables error. Err: %s", err)
+		newSsTables <- ssTables
+		return
+	}
+	recordCompaction(task.inputs, outputs, started)
+
+	compacted := make(map[uuid.UUID]bool)
+	for _, table := range task.inputs {
+		compacted[table.id] = true
+	}
+	for level := range levels {
+		remaining := make([]SsTable, 0, len(levels[level]))
+		for _, table := range levels[level] {
+			if !compacted[table.id] {
+				remaining = append(remaining, table)
+			}
+		}
+		levels[level] = remaining
+	}
+	levels[task.level] = append(levels[task.level], outputs...)
+	newSsTables <- flattenLevels(levels)
+}
+
+// groupByLevel splits ssTables by level keeping their relative order. Deeper
+// levels are sorted by key.
+func (merger *LeveledMerger) groupByLevel(ssTables []SsTable) [][]SsTable {
+	levels := make([][]SsTable, merger.MaxLevels)
+	for _, table := range ssTables {
+		level := table.level
+		if level >= merger.MaxLevels {
+			level = merger.MaxLevels - 1
+		}
+		levels[level] = append(levels[level], table)
+	}
+	for level := 1; level < len(levels); level++ {
+		sort.Slice(levels[level], func(i, j int) bool {
+			return levels[level][i].firstKey() < levels[level][j].firstKey()
+		})
+	}
+	return levels
+}
+
+func (merger *LeveledMerger) pickCompaction(levels [][]SsTable) *compaction {
+	if len(levels[0]) >= merger.L0CompactionTrigger {
+		inputs := overlapping(levels[1], levels[0])
+		// Level 1 tables are older than every level 0 table.
+		return &compaction{level: 1, inputs: append(inputs, levels[0]...)}
+	}
+
+	bestLevel, bestScore := -1, 1.0
+	target := merger.BaseLevelSize
+	for level := 1; level < len(levels)-1; level++ {
+		var size int64
+		for _, table := range levels[level] {
+			size += table.size
+		}
+		if score := float64(size) / float64(target); score > bestScore {
+			bestLevel, bestScore = level, score
+		}
+		target *= merger.LevelSizeMultiplier
+	}
+	if bestLevel == -1 {
+		return nil
+	}
+
+	if merger.compactPointers == nil {
+		merger.compactPointers = make(map[int]string)
+	}
+	picked := levels[bestLevel][0]
+	for _, table := range levels[bestLevel] {
+		if table.firstKey() > merger.compactPointers[bestLevel] {
+			picked = table
+			break
+		}
+	}
+	merger.compactPointers[bestLevel] = picked.lastKey()
+	inputs := overlapping(levels[bestLevel+1], []SsTable{picked})
+	return &compaction{level: bestLevel + 1, inputs: append(inputs, picked)}
+}
+
+// overlapping returns the tables of level that overlap the key range of tables.
+func overlapping(level []SsTable, tables []SsTable) []SsTable {
+	first, last := keyRange(tables)
+	result := make([]SsTable, 0)
+	for _, table := range level {
+		if table.overlaps(first, last) {
+			result = append(result, table)
+		}
+	}
+	return result
+}
+
+func keyRange(tables []SsTable) (string, string) {
+	var first, last string
+	isFirst := true
+	for _, table := range tables {
+		if len(table.ind) == 0 {
+			continue
+		}
+		if isFirst || table.firstKey() < first {
+			first = table.firstKey()
+		}
+		if isFirst || table.lastKey() > last {
+			last = table.lastKey()
+		}
+		isFirst = false
+	}
+	return first, last
+}
+
+func flattenLevels(levels [][]SsTable) []SsTable {
+	result := make([]SsTable, 0)
+	for level := len(levels) - 1; level >= 0; level-- {
+		result = append(result, levels[level]...)
+	}
+	return result
+}
@@ -0,0 +1,434 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The manifest is the record of which ssTables are live. CURRENT names the
+// manifest in use, a file starting with manifestMagic and followed by version
+// edits framed like WAL records. The first edit of a manifest adds every live
+// table, so a new manifest replaces the old one as soon as CURRENT points to it.
+//
+// An edit payload is a list of fields, each starting with its tag:
+//
+//	editAddTable | table id (16) | level | smallest seq | largest seq
+//	editRemoveTable | table id (16)
+//	editFlushedSeq | seq
+//
+// with every number but the id a uvarint.
+const (
+	currentFileName    = "CURRENT"
+	manifestPrefix     = "MANIFEST-"
+	manifestHeaderSize = 6
+	// maxManifestSize is the size past which a manifest is rewritten as a
+	// single edit.
+	maxManifestSize = 4 << 20
+
+	editAddTable    = 1
+	editRemoveTable = 2
+	editFlushedSeq  = 3
+)
+
+var manifestMagic = []byte("PHMAN\x01")
+
+// TableMeta describes a live ssTable. SmallestSeq and LargestSeq bound the
+// sequence numbers of the writes the table holds, both are zero for tables
+// written before sequence numbers were tracked.
+type TableMeta struct {
+	ID          uuid.UUID
+	Level       int
+	SmallestSeq uint64
+	LargestSeq  uint64
+}
+
+// VersionEdit is one change of the live ssTable set.
+type VersionEdit struct {
+	Added   []TableMeta
+	Removed []uuid.UUID
+	// FlushedSeq, when not zero, is the sequence number up to which every
+	// write is stored in live ssTables.
+	FlushedSeq uint64
+}
+
+// Version is the live ssTable set built by applying version edits in order.
+type Version struct {
+	Tables     []TableMeta
+	FlushedSeq uint64
+}
+
+func (version *Version) apply(edit VersionEdit) {
+	removed := make(map[uuid.UUID]bool, len(edit.Removed))
+	for _, id := range edit.Removed {
+		removed[id] = true
+	}
+	tables := make([]TableMeta, 0, len(version.Tables)+len(edit.Added))
+	for _, table := range version.Tables {
+		if !removed[table.ID] {
+			tables = append(tables, table)
+		}
+	}
+	version.Tables = append(tables, edit.Added...)
+	if edit.FlushedSeq > version.FlushedSeq {
+		version.FlushedSeq = edit.FlushedSeq
+	}
+}
+
+// ordered returns the tables from oldest to newest as the storage reads them:
+// deeper levels first and older writes first within a level. Tables with the
+// same sequence range keep the order they were added in.
+func (version *Version) ordered() []TableMeta {
+	tables := append([]TableMeta{}, version.Tables...)
+	sort.SliceStable(tables, func(i, j int) bool {
+		if tables[i].Level != tables[j].Level {
+			return tables[i].Level > tables[j].Level
+		}
+		return tables[i].LargestSeq < tables[j].LargestSeq
+	})
+	return tables
+}
+
+func (edit VersionEdit) encode() []byte {
+	payload := make([]byte, 0)
+	for _, table := range edit.Added {
+		payload = append(payload, editAddTable)
+		payload = append(payload, table.ID[:]...)
+		payload = binary.AppendUvarint(payload, uint64(table.Level))
+		payload = binary.AppendUvarint(payload, table.SmallestSeq)
+		payload = binary.AppendUvarint(payload, table.LargestSeq)
+	}
+	for _, id := range edit.Removed {
+		payload = append(payload, editRemoveTable)
+		payload = append(payload, id[:]...)
+	}
+	if edit.FlushedSeq != 0 {
+		payload = append(payload, editFlushedSeq)
+		payload = binary.AppendUvarint(payload, edit.FlushedSeq)
+	}
+	return payload
+}
+
+func decodeVersionEdit(payload []byte) (VersionEdit, error) {
+	var edit VersionEdit
+	readID := func() (uuid.UUID, bool) {
+		var id uuid.UUID
+		if len(payload) < len(id) {
+			return id, false
+		}
+		copy(id[:], payload)
+		payload = payload[len(id):]
+		return id, true
+	}
+	readUvarint := func() (uint64, bool) {
+		value, n := binary.Uvarint(payload)
+		if n <= 0 {
+			return 0, false
+		}
+		payload = payload[n:]
+		return value, true
+	}
+	for len(payload) != 0 {
+		tag := payload[0]
+		payload = payload[1:]
+		switch tag {
+		case editAddTable:
+			id, ok := readID()
+			level, levelOk := readUvarint()
+			smallest, smallestOk := readUvarint()
+			largest, largestOk := readUvarint()
+			if !ok || !levelOk || !smallestOk || !largestOk {
+				return VersionEdit{}, errBrokenRecord
+			}
+			edit.Added = append(edit.Added, TableMeta{ID: id, Level: int(level), SmallestSeq: smallest, LargestSeq: largest})
+		case editRemoveTable:
+			id, ok := readID()
+			if !ok {
+				return VersionEdit{}, errBrokenRecord
+			}
+			edit.Removed = append(edit.Removed, id)
+		case editFlushedSeq:
+			seq, ok := readUvarint()
+			if !ok {
+				return VersionEdit{}, errBrokenRecord
+			}
+			edit.FlushedSeq = seq
+		default:
+			return VersionEdit{}, fmt.Errorf("unknown version edit tag %d", tag)
+		}
+	}
+	return edit, nil
+}
+
+// Manifest appends version edits to the manifest in use.
+type Manifest struct {
+	mutex   sync.Mutex
+	dir     string
+	file    *os.File
+	number  uint64
+	size    int64
+	version Version
+}
+
+func manifestName(number uint64) string {
+	return fmt.Sprintf("%s%06d", manifestPrefix, number)
+}
+
+func parseManifestName(name string) (uint64, bool) {
+	if !strings.HasPrefix(name, manifestPrefix) {
+		return 0, false
+	}
+	number, err := strconv.ParseUint(strings.TrimPrefix(name, manifestPrefix), 10, 64)
+	return number, err == nil
+}
+
+// RecoverManifest reads the version of the manifest CURRENT names in dir. It
+// reports false when dir has no manifest yet. A torn last edit is ignored, it
+// was never acknowledged. A damaged edit followed by others is ErrCorruption:
+// the edits after it may add live tables, so no version can be trusted.
+func RecoverManifest(dir string) (Version, bool, error) {
+	current, err := os.ReadFile(filepath.Join(dir, currentFileName))
+	if os.IsNotExist(err) {
+		return Version{}, false, nil
+	}
+	if err != nil {
+		return Version{}, false, err
+	}
+	name := strings.TrimSpace(string(current))
+	if _, ok := parseManifestName(name); !ok {
+		return Version{}, false, fmt.Errorf("CURRENT names no manifest: %q", name)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return Version{}, false, err
+	}
+	if !bytes.HasPrefix(data, manifestMagic) {
+		return Version{}, false, fmt.Errorf("%s has no manifest header", name)
+	}
+	var version Version
+	path := filepath.Join(dir, name)
+	err = readFrames(path, data, manifestHeaderSize, func(payload []byte, offset int) error {
+		edit, err := decodeVersionEdit(payload)
+		if err != nil {
+			return fileCorruption(path, int64(offset), err.Error())
+		}
+		version.apply(edit)
+		return nil
+	})
+	if errors.Is(err, errTornTail) {
+		log.Printf("Replay manifest %s stopped. Err: %s", name, err)
+	} else if err != nil {
+		return Version{}, true, err
+	}
+	return version, true, nil
+}
+
+// CreateManifest writes a new manifest holding version, switches CURRENT to it
+// and removes the manifests it replaces.
+func CreateManifest(dir string, version Version) (*Manifest, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	number := uint64(1)
+	if current, err := os.ReadFile(filepath.Join(dir, currentFileName)); err == nil {
+		if previous, ok := parseManifestName(strings.TrimSpace(string(current))); ok {
+			number = previous + 1
+		}
+	}
+	manifest := &Manifest{dir: dir}
+	if err := manifest.switchTo(number, version); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// switchTo writes the version to the manifest with the given number and makes
+// it current. The caller holds the mutex or owns the manifest.
+func (manifest *Manifest) switchTo(number uint64, version Version) error {
+	path := filepath.Join(manifest.dir, manifestName(number))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	data := appendFrame(append([]byte{}, manifestMagic...), VersionEdit{Added: version.Tables, FlushedSeq: version.FlushedSeq}.encode())
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = setCurrent(manifest.dir, manifestName(number))
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+
+	if manifest.file != nil {
+		if err = manifest.file.Close(); err != nil {
+			log.Printf("Close manifest error. Err: %s", err)
+		}
+	}
+	manifest.file, manifest.number, manifest.size, manifest.version = file, number, int64(len(data)), version
+	entries, err := os.ReadDir(manifest.dir)
+	if err != nil {
+		log.Printf("Read ssTables dir error. Err: %s", err)
+		return nil
+	}
+	for _, entry := range entries {
+		if old, ok := parseManifestName(entry.Name()); ok && old != number {
+			if err = os.Remove(filepath.Join(manifest.dir, entry.Name())); err != nil {
+				log.Printf("Remove old manifest error. Err: %s", err)
+			}
+		}
+	}
+	return nil
+}
+
+// setCurrent points CURRENT to the named manifest with a rename, so CURRENT
+// names either the old or the new manifest after a crash.
+func setCurrent(dir string, name string) error {
+	tmpPath := filepath.Join(dir, currentFileName+".tmp")
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.WriteString(name + "\n"); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, filepath.Join(dir, currentFileName))
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(dir)
+}
+
+// LogEdit durably appends the edit. The tables it adds must already be
+// durable. A manifest grown past maxManifestSize is replaced by a new one
+// holding the resulting version.
+func (manifest *Manifest) LogEdit(edit VersionEdit) error {
+	manifest.mutex.Lock()
+	defer manifest.mutex.Unlock()
+	version := Version{Tables: append([]TableMeta{}, manifest.version.Tables...), FlushedSeq: manifest.version.FlushedSeq}
+	version.apply(edit)
+	if manifest.size >= maxManifestSize {
+		return manifest.switchTo(manifest.number+1, version)
+	}
+	frame := appendFrame(nil, edit.encode())
+	n, err := manifest.file.Write(frame)
+	manifest.size += int64(n)
+	if err == nil {
+		err = manifest.file.Sync()
+	}
+	if err != nil {
+		// The edit may be partly written, only a new manifest is safe to
+		// append to.
+		if switchErr := manifest.switchTo(manifest.number+1, manifest.version); switchErr != nil {
+			log.Printf("Replace manifest error. Err: %s", switchErr)
+		}
+		return err
+	}
+	manifest.version = version
+	return nil
+}
+
+func (manifest *Manifest) Close() error {
+	manifest.mutex.Lock()
+	defer manifest.mutex.Unlock()
+	return manifest.file.Close()
+}
+
+// meta returns the manifest entry of the table.
+func (table *SsTable) meta() TableMeta {
+	return TableMeta{ID: table.id, Level: table.level, SmallestSeq: table.smallestSeq, LargestSeq: table.largestSeq}
+}
+
+// OpenTables opens the tables of the version stored in dir, oldest first.
+func OpenTables(dir string, version Version, cache *BlockCache) []SsTable {
+	tables := make([]SsTable, 0, len(version.Tables))
+	for _, meta := range version.ordered() {
+		id := meta.ID.String()
+		log.Printf("Restoring ssTable %s", id)
+		// Only tables written before the index moved into the table file have a journal.
+		table := Restore(filepath.Join(dir, id+".gz"), filepath.Join(dir, "journal", id+".bin"), cache)
+		table.level, table.smallestSeq, table.largestSeq = meta.Level, meta.SmallestSeq, meta.LargestSeq
+		tables = append(tables, table)
+	}
+	return tables
+}
+
+// RemoveOrphans deletes the files of dir that belong to no table of the
+// version: compaction inputs and tables written but never logged before a
+// crash, uncompressed table files, stale index journals and temporary files
+// left by a crash. Unknown files are kept.
+func RemoveOrphans(dir string, version Version) {
+	live := make(map[uuid.UUID]bool, len(version.Tables))
+	for _, table := range version.Tables {
+		live[table.ID] = true
+	}
+	remove := func(path string) {
+		log.Printf("Remove orphaned file %s", path)
+		if err := os.Remove(path); err != nil {
+			log.Printf("Remove orphaned file error. Err: %s", err)
+		}
+	}
+	isOrphan := func(name string, extensions ...string) bool {
+		ext := filepath.Ext(name)
+		id, err := uuid.Parse(strings.TrimSuffix(name, ext))
+		if err != nil {
+			return false
+		}
+		for _, extension := range extensions {
+			if ext == extension {
+				return !live[id]
+			}
+		}
+		return false
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("Read ssTables dir error. Err: %s", err)
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		switch {
+		case entry.IsDir():
+		case name == currentFileName+".tmp" || strings.HasSuffix(name, ".bloom.tmp"):
+			remove(filepath.Join(dir, name))
+		case filepath.Ext(name) == ".bin":
+			// Uncompressed table files are not read again once zipped.
+			if _, err := uuid.Parse(strings.TrimSuffix(name, ".bin")); err == nil {
+				remove(filepath.Join(dir, name))
+			}
+		case isOrphan(name, ".gz", ".bloom"):
+			remove(filepath.Join(dir, name))
+		}
+	}
+
+	journalDir := filepath.Join(dir, "journal")
+	entries, err = os.ReadDir(journalDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Read ssTables journal dir error. Err: %s", err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && isOrphan(entry.Name(), ".bin") {
+			remove(filepath.Join(journalDir, entry.Name()))
+		}
+	}
+}
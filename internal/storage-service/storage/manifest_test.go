@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"errors"
+	"github.com/google/uuid"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// A manifest whose last edit is torn or corrupt recovers the version before
+// that edit, which was never acknowledged, and accepts new edits again.
+func TestRecoverManifestWithTornLastEdit(t *testing.T) {
+	first, second, third := TableMeta{ID: uuid.New()}, TableMeta{ID: uuid.New(), Level: 1}, TableMeta{ID: uuid.New(), Level: 1}
+	initial := Version{Tables: []TableMeta{first}}
+	beforeLast := Version{Tables: []TableMeta{first, second}, FlushedSeq: 10}
+	complete := Version{Tables: []TableMeta{second, third}, FlushedSeq: 20}
+	tests := []struct {
+		name string
+		// firstEdit picks the edit the damage is done at, the first or the last
+		// logged one.
+		firstEdit bool
+		damage    fileDamage
+		want      Version
+	}{
+		{"intact", false, intact(), complete},
+		{"last byte cut", false, cutEnd(1), beforeLast},
+		{"cut inside the edit header", false, cutAt(5), beforeLast},
+		{"only the edit header written", false, cutAt(walFrameHeader), beforeLast},
+		{"payload bit flipped", false, flipBits(walFrameHeader+1, 0x04), beforeLast},
+		{"checksum bit flipped", false, flipBits(4, 0x01), beforeLast},
+		{"both edits torn", true, cutAt(2), initial},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			manifest, err := CreateManifest(dir, initial)
+			if err != nil {
+				t.Fatal(err)
+			}
+			firstOffset := int(manifest.size)
+			if err = manifest.LogEdit(VersionEdit{Added: []TableMeta{second}, FlushedSeq: 10}); err != nil {
+				t.Fatal(err)
+			}
+			lastOffset := int(manifest.size)
+			if err = manifest.LogEdit(VersionEdit{Added: []TableMeta{third}, Removed: []uuid.UUID{first.ID}, FlushedSeq: 20}); err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(dir, manifestName(manifest.number))
+			manifest.Close()
+			if test.firstEdit {
+				damageFile(t, path, test.damage, firstOffset)
+			} else {
+				damageFile(t, path, test.damage, lastOffset)
+			}
+
+			version, found, err := RecoverManifest(dir)
+			if err != nil || !found {
+				t.Fatalf("RecoverManifest = %v, %v", found, err)
+			}
+			if !reflect.DeepEqual(version, test.want) {
+				t.Fatalf("recovered %+v, want %+v", version, test.want)
+			}
+
+			manifest, err = CreateManifest(dir, version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			added := TableMeta{ID: uuid.New()}
+			if err = manifest.LogEdit(VersionEdit{Added: []TableMeta{added}}); err != nil {
+				t.Fatal(err)
+			}
+			manifest.Close()
+			version, _, err = RecoverManifest(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := append(append([]TableMeta{}, test.want.Tables...), added); !reflect.DeepEqual(version.Tables, want) {
+				t.Fatalf("recovered %+v after the next edit, want tables %+v", version, want)
+			}
+		})
+	}
+}
+
+// A damaged edit followed by other edits is corruption, not a torn tail: the
+// edits after it may add live tables, so recovery must not return a version.
+func TestRecoverManifestWithCorruptEdit(t *testing.T) {
+	tests := []struct {
+		name string
+		// damage is done at the start of the middle edit.
+		damage fileDamage
+	}{
+		{"payload bit flipped", flipBits(walFrameHeader+1, 0x04)},
+		{"checksum bit flipped", flipBits(4, 0x01)},
+		{"length shortened", addTo(0, -1)},
+		{"length too large", setTo(3, 0x7f)},
+		{"zeroed edit", zeroOut(0, walFrameHeader+4)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			manifest, err := CreateManifest(dir, Version{Tables: []TableMeta{{ID: uuid.New()}}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			middleOffset := 0
+			for i := 0; i < 3; i++ {
+				if i == 1 {
+					middleOffset = int(manifest.size)
+				}
+				if err = manifest.LogEdit(VersionEdit{Added: []TableMeta{{ID: uuid.New()}}, FlushedSeq: uint64(10 * (i + 1))}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			path := filepath.Join(dir, manifestName(manifest.number))
+			manifest.Close()
+			damageFile(t, path, test.damage, middleOffset)
+
+			version, found, err := RecoverManifest(dir)
+			var corruption *ErrCorruption
+			if !errors.As(err, &corruption) || !found {
+				t.Fatalf("RecoverManifest = %+v, %v, %v, want corruption", version, found, err)
+			}
+			// A zeroed frame header reads as an empty edit, the damage shows
+			// at the next frame.
+			if corruption.Offset < int64(middleOffset) || corruption.Path != path {
+				t.Fatalf("corruption is reported at %s offset %d, the damage is at offset %d", corruption.Path, corruption.Offset, middleOffset)
+			}
+		})
+	}
+}
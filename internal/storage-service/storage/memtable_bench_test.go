@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// The MemTable benchmarks run concurrent readers and writers over a prefilled
+// key space, once per percentage of reads. Compare the implementations under
+// several GOMAXPROCS values with
+//
+//	go test -run '^$' -bench BenchmarkMemTable -cpu 1,4,8 ./internal/storage-service/storage
+const (
+	benchKeys      = 100000
+	benchValueSize = 100
+)
+
+var benchReadRatios = []int{0, 50, 90, 99}
+
+func BenchmarkMemTableAvl(b *testing.B) {
+	benchmarkMemTable(b, "avl")
+}
+
+func BenchmarkMemTableSkipList(b *testing.B) {
+	benchmarkMemTable(b, "skiplist")
+}
+
+func benchmarkMemTable(b *testing.B, kind string) {
+	keySpace := make([]string, 2*benchKeys)
+	for i := range keySpace {
+		keySpace[i] = fmt.Sprintf("key%010d", i)
+	}
+	value := strings.Repeat("v", benchValueSize)
+	for _, ratio := range benchReadRatios {
+		b.Run(fmt.Sprintf("reads=%d%%", ratio), func(b *testing.B) {
+			memTable := newPrefilledMemTable(b, kind, keySpace[:benchKeys], value)
+			runMemTableBenchmark(b, memTable, keySpace, value, ratio)
+		})
+	}
+}
+
+// newPrefilledMemTable returns a MemTable holding every key. Its size limit is
+// never reached, so the benchmark measures the data structure alone.
+func newPrefilledMemTable(b *testing.B, kind string, keys []string, value string) MemTable {
+	b.Helper()
+	memTable, err := NewMemTable(kind, ^uintptr(0))
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i, key := range keys {
+		memTable.Add(key, value, uint64(i+1))
+	}
+	return memTable
+}
+
+// runMemTableBenchmark reads keys with readRatio percent probability and
+// writes them otherwise. Half of the key space is prefilled, so writes both
+// update and insert.
+func runMemTableBenchmark(b *testing.B, memTable MemTable, keySpace []string, value string, readRatio int) {
+	var seed atomic.Int64
+	var seq atomic.Uint64
+	seq.Store(uint64(len(keySpace)))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		random := rand.New(rand.NewSource(seed.Add(1)))
+		for pb.Next() {
+			key := keySpace[random.Intn(len(keySpace))]
+			if random.Intn(100) < readRatio {
+				memTable.Find(key, MaxSeq)
+			} else {
+				memTable.Add(key, value, seq.Add(1))
+			}
+		}
+	})
+}
@@ -1,281 +1,146 @@
 package storage
 
 import (
-	"fmt"
 	"github.com/google/uuid"
 	"log"
-	"os"
 	"path/filepath"
-	"sort"
-	"strings"
 	"sync"
+	"time"
 )
 
+// Merger compacts ssTables. Merged tables keep the versions the snapshots,
+// sequence numbers in ascending order, read.
 type Merger interface {
-	MergeAndCompaction(ssTables []SsTable, newSsTables chan<- []SsTable)
+	MergeAndCompaction(ssTables []SsTable, snapshots []uint64, newSsTables chan<- []SsTable)
 }
 
 type MergerImpl struct {
 	MemNewFileLimit      uintptr
 	StorageSstDirPath    string
 	SsTableSegmentLength int64
+	BloomBitsPerKey      int
+	BlockCache           *BlockCache
+	Compression          Compression
 	Mutex                sync.Mutex
 }
 
-func (merger MergerImpl) MergeAndCompaction(ssTables []SsTable, newSsTables chan<- []SsTable) {
+func (merger *MergerImpl) MergeAndCompaction(ssTables []SsTable, snapshots []uint64, newSsTables chan<- []SsTable) {
 	merger.Mutex.Lock()
 	defer merger.Mutex.Unlock()
 	if len(ssTables) < 2 {
 		newSsTables <- ssTables
 		return
 	}
-	result := merger.MergeDescenting(ssTables)
+	started := time.Now()
+	result, err := merger.Merge(ssTables, snapshots, true)
+	if err != nil {
+		log.Printf("Merge ssTables error. Err: %s", err)
+		newSsTables <- ssTables
+		return
+	}
+	recordCompaction(ssTables, result, started)
 	newSsTables <- result
 	return
 }
 
 type KeyValue struct {
-	Key   string
-	Value string
+	Key     string
+	Value   string
+	Deleted bool
+	// Seq is the sequence number of the write, zero for writes made before
+	// writes were numbered.
+	Seq uint64
 }
 
-type Segment struct {
-	First int64
-	Last  int64
+// Merge merges ssTables ordered from oldest to newest into new tables of at most
+// MemNewFileLimit bytes each. Newer values win, older versions are kept only
+// for the snapshots that read them. Tombstones are dropped only when
+// dropTombstones is set, i.e. no table older than ssTables can hold the key.
+func (merger *MergerImpl) Merge(ssTables []SsTable, snapshots []uint64, dropTombstones bool) ([]SsTable, error) {
+	return merger.merge(ssTables, snapshots, dropTombstones, merger.MemNewFileLimit, 0)
 }
 
-type SSTFile struct {
-	FilePath string
-	Segments []Segment
-}
-
-func (sstFile *SSTFile) init(ssTable SsTable) {
-	sstFile.FilePath = ssTable.dPath
-	sstFile.Segments = make([]Segment, 0)
-	for _, v := range ssTable.ind {
-		segment := Segment{
-			First: v.start,
-			Last:  v.end,
-		}
-		sstFile.Segments = append(sstFile.Segments, segment)
+// merge is Merge with the output table size limit and level given explicitly.
+// A zero newFileLimit writes a single table. The versions of a key always go
+// to the same table.
+func (merger *MergerImpl) merge(ssTables []SsTable, snapshots []uint64, dropTombstones bool, newFileLimit uintptr, level int) ([]SsTable, error) {
+	iterators := make([]Iterator, 0, len(ssTables))
+	for i := len(ssTables) - 1; i >= 0; i-- {
+		iterators = append(iterators, NewSsTableIterator(&ssTables[i]))
 	}
+	it := NewMergingIterator(iterators)
+	defer it.Close()
 
-	sort.Slice(sstFile.Segments, func(i, j int) bool {
-		return sstFile.Segments[i].First < sstFile.Segments[j].First
+	result := make([]SsTable, 0)
+	keyValuePool := make([]KeyValue, 0)
+	// size in bytes
+	var curNewFileSize uintptr
+	err := compactVersions(it, snapshots, dropTombstones, func(keyValue KeyValue) error {
+		dataSize := (uintptr)(seqRecordSize(keyValue))
+		newKey := len(keyValuePool) == 0 || keyValuePool[len(keyValuePool)-1].Key != keyValue.Key
+		if newFileLimit != 0 && dataSize+curNewFileSize > newFileLimit && len(keyValuePool) != 0 && newKey {
+			newTable, err := merger.MakeSsTable(keyValuePool, level)
+			if err != nil {
+				return err
+			}
+			result = append(result, newTable)
+			keyValuePool = make([]KeyValue, 0)
+			curNewFileSize = 0
+		}
+		curNewFileSize += dataSize
+		keyValuePool = append(keyValuePool, keyValue)
+		return nil
 	})
-}
-
-func (merger MergerImpl) GetUnzipSegment(ssTFile SSTFile, segmentNumber int) ([]KeyValue, error) {
-	result := make([]KeyValue, 0)
-	var zipper Zip
-	zipper = GZip{}
-	file, err := os.OpenFile(ssTFile.FilePath, os.O_RDONLY, 0644)
 	if err != nil {
-		return result, err
+		releaseTables(result)
+		return nil, err
 	}
-	defer func() {
-		if err = file.Close(); err != nil {
-			log.Printf("Close sstable file error. Err: %s", err)
+	if len(keyValuePool) != 0 {
+		newTable, err := merger.MakeSsTable(keyValuePool, level)
+		if err != nil {
+			releaseTables(result)
+			return nil, err
 		}
-	}()
-	_, err = file.Seek(ssTFile.Segments[segmentNumber].First, 0)
-	if err != nil {
-		return result, nil
-	}
-
-	data := make([]byte, ssTFile.Segments[segmentNumber].Last-ssTFile.Segments[segmentNumber].First)
-	n, err := file.Read(data)
-	if err != nil {
-		return result, nil
+		result = append(result, newTable)
 	}
-	decompressedData := zipper.Unzip(&data)
-	segment := string(decompressedData[:n])
-	keyValuePairs := strings.Split(segment, ";")
-	for _, kvp := range keyValuePairs {
-		pairElements := strings.Split(kvp, ":")
-		storageKey := pairElements[0]
-		storageValue := pairElements[1]
-		keyValue := KeyValue{
-			Value: storageValue,
-			Key:   storageKey,
-		}
-		result = append(result, keyValue)
+	smallestSeq, largestSeq := seqRange(ssTables)
+	for i := range result {
+		result[i].smallestSeq, result[i].largestSeq = smallestSeq, largestSeq
+		result[i].level = level
 	}
 
 	return result, nil
 }
 
-func (merger MergerImpl) GetNextSeg(curFile1SegLine *int, file1Seg *[]KeyValue, curFile1Seg *int, files1 []SSTFile, curFile1 *int, files1Len *int) ([]KeyValue, error) {
-	var err error
-	if *curFile1SegLine == len(*file1Seg) {
-		if *curFile1 != *files1Len {
-			if *curFile1Seg == len(files1[*curFile1].Segments) {
-				*curFile1++
-				*curFile1Seg = 0
-			}
-		} else {
-			err = os.ErrNotExist
-			return *file1Seg, err
+// seqRange bounds the sequence numbers of the writes held by ssTables.
+func seqRange(ssTables []SsTable) (uint64, uint64) {
+	if len(ssTables) == 0 {
+		return 0, 0
+	}
+	smallest, largest := ssTables[0].smallestSeq, ssTables[0].largestSeq
+	for _, table := range ssTables[1:] {
+		if table.smallestSeq < smallest {
+			smallest = table.smallestSeq
 		}
-
-		if *curFile1 != *files1Len {
-			*curFile1SegLine = 0
-			*file1Seg, _ = merger.GetUnzipSegment(files1[*curFile1], *curFile1Seg)
-			*curFile1Seg++
-			err = nil
-		} else {
-			err = os.ErrNotExist
+		if table.largestSeq > largest {
+			largest = table.largestSeq
 		}
-	} else {
-		err = nil
 	}
-
-	return *file1Seg, err
+	return smallest, largest
 }
 
-func (merger MergerImpl) MakeSsTable(keyValuePool []KeyValuePair) SsTable {
+// MakeSsTable writes a new table of the given level compressed with the codec
+// of the level.
+func (merger *MergerImpl) MakeSsTable(keyValuePool []KeyValue, level int) (SsTable, error) {
 
 	var id = uuid.New()
 	filePath := filepath.Join(merger.StorageSstDirPath, id.String())
-	journalPath := filepath.Join(merger.StorageSstDirPath, "journal")
-	err := os.Mkdir(journalPath, 0777)
-	if err != nil {
-		log.Printf("error occuring while creating ssTable journal dir. Err: %s", err)
-	}
-	var newTable = SsTable{dPath: filePath + ".bin", jPath: filepath.Join(journalPath, id.String()) + ".bin", segLen: merger.SsTableSegmentLength, ind: make(map[string]SparseIndices),
-		id: uuid.New()}
-	err = newTable.InitFromSlice(keyValuePool)
+	var newTable = SsTable{dPath: filePath + ".gz", bPath: filePath + ".bloom", segLen: merger.SsTableSegmentLength,
+		id: id, bloomBitsPerKey: merger.BloomBitsPerKey, cache: merger.BlockCache, codec: merger.Compression.ForLevel(level)}
+	err := newTable.InitFromSlice(keyValuePool)
 	if err != nil {
-		return SsTable{}
-	}
-	return newTable
-
-}
-
-func (merger MergerImpl) WriteTail(curFile1SegLine *int, curFile1Seg *int, file1SegPtr *[]KeyValue, curFile1 *int, files1 *[]SSTFile, result *[]SsTable, keyValuePool *[]KeyValuePair) {
-	isFirst := true
-	files1Len := len(*files1)
-	var curNewFileSize uintptr
-	file1Seg := *file1SegPtr
-	for true {
-		var err error
-		file1Seg, err = merger.GetNextSeg(curFile1SegLine, &file1Seg, curFile1Seg, *files1, curFile1, &files1Len)
-		if err != nil {
-			return
-		}
-
-		key := file1Seg[*curFile1SegLine].Key
-		value := file1Seg[*curFile1SegLine].Value
-		*curFile1SegLine++
-		line := ";" + key + ":" + value
-		if isFirst {
-			line = key + ":" + value
-			isFirst = false
-		}
-		data := []byte(line)
-		dataSize := (uintptr)(len(data))
-		if dataSize+curNewFileSize <= merger.MemNewFileLimit {
-			curNewFileSize += dataSize
-			*keyValuePool = append(*keyValuePool, KeyValuePair{Key: key, Value: value})
-		} else {
-			isFirst = true
-			curNewFileSize = 0
-			*result = append(*result, merger.MakeSsTable(*keyValuePool))
-			*keyValuePool = make([]KeyValuePair, 0)
-			*keyValuePool = append(*keyValuePool, KeyValuePair{Key: key, Value: value})
-			curNewFileSize = dataSize
-		}
-	}
-}
-
-func (merger MergerImpl) Merge(ssT1 []SsTable, ssT2 []SsTable) []SsTable {
-	result := make([]SsTable, 0)
-	files1 := make([]SSTFile, 0)
-	files2 := make([]SSTFile, 0)
-	for _, sst := range ssT1 {
-		ssTFile := SSTFile{}
-		ssTFile.init(sst)
-		files1 = append(files1, ssTFile)
-	}
-	for _, sst := range ssT2 {
-		ssTFile := SSTFile{}
-		ssTFile.init(sst)
-		files2 = append(files2, ssTFile)
-	}
-	curFile1, curFile2 := 0, 0
-	curFile1Seg, curFile2Seg := 0, 0
-	curFile1SegLine, curFile2SegLine := 0, 0
-
-	files1Len, files2Len := len(files1), len(files2)
-
-	file1Seg, _ := merger.GetUnzipSegment(files1[curFile1], curFile1Seg)
-	file2Seg, _ := merger.GetUnzipSegment(files2[curFile2], curFile2Seg)
-	curFile1Seg++
-	curFile2Seg++
-
-	// size in bytes
-	var curNewFileSize uintptr
-	isFirst := true
-	keyValuePool := make([]KeyValuePair, 0)
-	for true {
-		var key, value string
-		if file1Seg[curFile1SegLine].Key == file2Seg[curFile2SegLine].Key {
-			key = file2Seg[curFile2SegLine].Key
-			value = file2Seg[curFile2SegLine].Value
-			curFile1SegLine++
-			curFile2SegLine++
-		} else if file1Seg[curFile1SegLine].Key < file2Seg[curFile2SegLine].Key {
-			key = file1Seg[curFile1SegLine].Key
-			value = file1Seg[curFile1SegLine].Value
-			curFile1SegLine++
-		} else if file1Seg[curFile1SegLine].Key > file2Seg[curFile2SegLine].Key {
-			key = file2Seg[curFile2SegLine].Key
-			value = file2Seg[curFile2SegLine].Value
-			curFile2SegLine++
-		}
-
-		line := ";" + key + ":" + value
-		if isFirst {
-			line = key + ":" + value
-			isFirst = false
-		}
-		data := []byte(line)
-		dataSize := (uintptr)(len(data))
-		if dataSize+curNewFileSize <= merger.MemNewFileLimit {
-			curNewFileSize += dataSize
-			keyValuePool = append(keyValuePool, KeyValuePair{Key: key, Value: value})
-		} else {
-			isFirst = true
-			curNewFileSize = 0
-			result = append(result, merger.MakeSsTable(keyValuePool))
-			keyValuePool = make([]KeyValuePair, 0)
-			keyValuePool = append(keyValuePool, KeyValuePair{Key: key, Value: value})
-			curNewFileSize = dataSize
-		}
-		var err error
-		file1Seg, err = merger.GetNextSeg(&curFile1SegLine, &file1Seg, &curFile1Seg, files1, &curFile1, &files1Len)
-		if err != nil {
-			merger.WriteTail(&curFile1SegLine, &curFile1Seg, &file1Seg, &curFile1, &files1, &result, &keyValuePool)
-			break
-		}
-		file2Seg, err = merger.GetNextSeg(&curFile2SegLine, &file2Seg, &curFile2Seg, files2, &curFile2, &files2Len)
-		if err != nil {
-			merger.WriteTail(&curFile2SegLine, &curFile2Seg, &file2Seg, &curFile2, &files2, &result, &keyValuePool)
-			break
-		}
-	}
-
-	return result
-}
-
-func (merger MergerImpl) MergeDescenting(ssTables []SsTable) []SsTable {
-	if len(ssTables) <= 1 {
-		return ssTables
+		return SsTable{}, err
 	}
-	mid := len(ssTables) / 2
-	fmt.Println(mid)
-	leftSsT := merger.MergeDescenting(ssTables[:mid])
-	rightSsT := merger.MergeDescenting(ssTables[mid:])
+	return newTable, nil
 
-	return merger.Merge(leftSsT, rightSsT)
 }
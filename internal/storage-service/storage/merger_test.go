@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// A merge keeps a tombstone over the values it deletes unless no older table
+// can hold the key, and keeps what the live snapshots read.
+func TestMergeTombstones(t *testing.T) {
+	tests := []struct {
+		name string
+		// tables are ordered from oldest to newest, their entries are sorted.
+		tables         [][]KeyValue
+		snapshots      []uint64
+		dropTombstones bool
+		want           []KeyValue
+	}{
+		{"tombstone over a value", [][]KeyValue{
+			{{Key: "a", Value: "1", Seq: 1}, {Key: "b", Value: "2", Seq: 2}},
+			{{Key: "a", Deleted: true, Seq: 3}},
+		}, nil, false, []KeyValue{{Key: "a", Deleted: true, Seq: 3}, {Key: "b", Value: "2", Seq: 2}}},
+		{"tombstone over a value dropped", [][]KeyValue{
+			{{Key: "a", Value: "1", Seq: 1}, {Key: "b", Value: "2", Seq: 2}},
+			{{Key: "a", Deleted: true, Seq: 3}},
+		}, nil, true, []KeyValue{{Key: "b", Value: "2", Seq: 2}}},
+		{"tombstone alone", [][]KeyValue{
+			{{Key: "b", Value: "2", Seq: 2}},
+			{{Key: "a", Deleted: true, Seq: 3}},
+		}, nil, false, []KeyValue{{Key: "a", Deleted: true, Seq: 3}, {Key: "b", Value: "2", Seq: 2}}},
+		{"value after a tombstone", [][]KeyValue{
+			{{Key: "a", Value: "1", Seq: 1}},
+			{{Key: "a", Deleted: true, Seq: 3}},
+			{{Key: "a", Value: "again", Seq: 5}},
+		}, nil, false, []KeyValue{{Key: "a", Value: "again", Seq: 5}}},
+		{"snapshot reads the deleted value", [][]KeyValue{
+			{{Key: "a", Value: "1", Seq: 1}},
+			{{Key: "a", Deleted: true, Seq: 3}},
+		}, []uint64{2}, true, []KeyValue{{Key: "a", Deleted: true, Seq: 3}, {Key: "a", Value: "1", Seq: 1}}},
+		{"snapshot reads the tombstone", [][]KeyValue{
+			{{Key: "a", Value: "1", Seq: 1}},
+			{{Key: "a", Deleted: true, Seq: 3}},
+			{{Key: "a", Value: "again", Seq: 5}},
+		}, []uint64{4}, false, []KeyValue{{Key: "a", Value: "again", Seq: 5}, {Key: "a", Deleted: true, Seq: 3}}},
+		{"snapshot tombstone dropped when oldest", [][]KeyValue{
+			{{Key: "a", Value: "1", Seq: 1}},
+			{{Key: "a", Deleted: true, Seq: 3}},
+			{{Key: "a", Value: "again", Seq: 5}},
+		}, []uint64{4}, true, []KeyValue{{Key: "a", Value: "again", Seq: 5}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			tables := make([]SsTable, 0, len(test.tables))
+			for _, keyValues := range test.tables {
+				tables = append(tables, *writeTestTable(t, dir, 100, keyValues))
+			}
+			merger := &MergerImpl{StorageSstDirPath: dir, SsTableSegmentLength: 100, BloomBitsPerKey: 10}
+			merged, err := merger.Merge(tables, test.snapshots, test.dropTombstones)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]KeyValue, 0)
+			for i := range merged {
+				got = append(got, collect(t, NewSsTableIterator(&merged[i]), "")...)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("merged %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+// A compaction of the newer tables only keeps the tombstone, so the value in
+// the older table stays deleted.
+func TestMergedTombstoneShadowsOlderTable(t *testing.T) {
+	storage := newTestStorage(t, 1<<20, 100)
+	for _, write := range []func() error{
+		func() error { return testSet(storage, "key", "value") },
+		func() error { return testDelete(storage, "key") },
+		func() error { return testSet(storage, "other", "value") },
+	} {
+		if err := write(); err != nil {
+			t.Fatal(err)
+		}
+		testFlush(t, storage)
+	}
+	tables := *storage.SsTables
+	if len(tables) != 3 {
+		t.Fatalf("storage holds %d tables, want 3", len(tables))
+	}
+	merged, err := storage.Merger.(*MergerImpl).Merge(tables[1:], nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	*storage.SsTables = append([]SsTable{tables[0]}, merged...)
+	if value, err := testGet(storage, "key"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("deleted key reads as %q, %v after the merge", value, err)
+	}
+	if keyValues, err := testScan(storage, "", "", 0); err != nil || len(keyValues) != 1 || keyValues[0].Key != "other" {
+		t.Fatalf("scan read %+v, %v after the merge", keyValues, err)
+	}
+}
@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"strings"
+)
+
+// Records are stored as a kind byte followed by the uvarint length prefixed
+// key and value, so keys and values may hold arbitrary bytes.
+const (
+	recordPut    byte = 1
+	recordDelete byte = 2
+)
+
+var errBrokenRecord = errors.New("broken record")
+
+type segmentFormat int
+
+const (
+	// textSegmentFormat is the legacy "key:value;key:value" segment layout.
+	textSegmentFormat segmentFormat = iota
+	// seqRecordSegmentFormat records are preceded by the uvarint sequence
+	// number of the write.
+	seqRecordSegmentFormat
+)
+
+func AppendRecord(buf []byte, key string, value string, deleted bool) []byte {
+	if deleted {
+		buf = append(buf, recordDelete)
+		value = ""
+	} else {
+		buf = append(buf, recordPut)
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(key)))
+	buf = append(buf, key...)
+	buf = binary.AppendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+func recordSize(key string, value string) int {
+	return 1 + uvarintSize(len(key)) + len(key) + uvarintSize(len(value)) + len(value)
+}
+
+func uvarintSize(n int) int {
+	return uvarintSize64(uint64(n))
+}
+
+func uvarintSize64(n uint64) int {
+	size := 1
+	for ; n >= 0x80; n >>= 7 {
+		size++
+	}
+	return size
+}
+
+// DecodeRecord decodes the record at the start of data and returns it with the
+// number of bytes read.
+func DecodeRecord(data []byte) (KeyValue, int, error) {
+	if len(data) == 0 {
+		return KeyValue{}, 0, errBrokenRecord
+	}
+	kind := data[0]
+	if kind != recordPut && kind != recordDelete {
+		return KeyValue{}, 0, errBrokenRecord
+	}
+	pos := 1
+	key, n := readBytes(data[pos:])
+	if n <= 0 {
+		return KeyValue{}, 0, errBrokenRecord
+	}
+	pos += n
+	value, n := readBytes(data[pos:])
+	if n <= 0 {
+		return KeyValue{}, 0, errBrokenRecord
+	}
+	pos += n
+	return KeyValue{Key: string(key), Value: string(value), Deleted: kind == recordDelete}, pos, nil
+}
+
+func readBytes(data []byte) ([]byte, int) {
+	length, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) < length {
+		return nil, 0
+	}
+	return data[n : n+int(length)], n + int(length)
+}
+
+// appendSeqRecord appends the record of a seqRecordSegmentFormat segment.
+func appendSeqRecord(buf []byte, keyValue KeyValue) []byte {
+	buf = binary.AppendUvarint(buf, keyValue.Seq)
+	return AppendRecord(buf, keyValue.Key, keyValue.Value, keyValue.Deleted)
+}
+
+func seqRecordSize(keyValue KeyValue) int {
+	return uvarintSize64(keyValue.Seq) + recordSize(keyValue.Key, keyValue.Value)
+}
+
+func decodeSeqRecords(data []byte) ([]KeyValue, error) {
+	result := make([]KeyValue, 0)
+	for len(data) != 0 {
+		seq, n := binary.Uvarint(data)
+		if n <= 0 {
+			return result, errBrokenRecord
+		}
+		keyValue, m, err := DecodeRecord(data[n:])
+		if err != nil {
+			return result, err
+		}
+		keyValue.Seq = seq
+		result = append(result, keyValue)
+		data = data[n+m:]
+	}
+	return result, nil
+}
+
+func parseSegment(segment []byte, format segmentFormat) ([]KeyValue, error) {
+	switch format {
+	case seqRecordSegmentFormat:
+		return decodeSeqRecords(segment)
+	}
+	return parseTextSegment(string(segment)), nil
+}
+
+func parseTextSegment(segment string) []KeyValue {
+	result := make([]KeyValue, 0)
+	// Text segments are padded with zero bytes to the segment length.
+	segment = strings.TrimRight(segment, "\x00")
+	keyValuePairs := strings.Split(segment, ";")
+	for _, kvp := range keyValuePairs {
+		pairElements := strings.Split(kvp, ":")
+		keyValue := KeyValue{Key: pairElements[0], Deleted: len(pairElements) == 1}
+		if !keyValue.Deleted {
+			keyValue.Value = pairElements[1]
+		}
+		result = append(result, keyValue)
+	}
+	return result
+}
+
+// ReadJournal returns the entries of a MemTable journal written before the
+// binary WAL in write order. The journal is parsed line by line.
+func ReadJournal(journalPath string) ([]KeyValue, error) {
+	data, err := os.ReadFile(journalPath)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]KeyValue, 0)
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		var logInfo = strings.Split(strings.Split(sc.Text(), ".")[0], ":")
+		if len(logInfo) < 2 || len(logInfo[1]) == 0 {
+			continue
+		}
+		keyValue := KeyValue{Key: logInfo[1][1:]}
+		if strings.HasPrefix(sc.Text(), "Delete key: ") {
+			keyValue.Deleted = true
+		} else if len(logInfo) > 2 {
+			keyValue.Value = logInfo[2]
+		}
+		result = append(result, keyValue)
+	}
+	return result, sc.Err()
+}
@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// An ssTable holds one reference for its owner, the live set or the
+// compaction or flush that wrote it, and one for every reader that walks it
+// outside the storage lock. The files of a table are deleted once the last
+// reference is released, so a table dropped by compaction stays readable
+// until the reads in flight finish.
+
+func newTableRefs() *atomic.Int64 {
+	refs := new(atomic.Int64)
+	refs.Store(1)
+	return refs
+}
+
+func (table *SsTable) ref() {
+	table.refs.Add(1)
+}
+
+// unref releases a reference and deletes the table files with the last one.
+func (table *SsTable) unref() {
+	if table.refs.Add(-1) == 0 {
+		table.removeFiles()
+	}
+}
+
+// removeFiles deletes every file of the table and reports the reclaimed space
+// in StorageStats.
+func (table *SsTable) removeFiles() {
+	table.cache.EvictTable(table.id)
+	paths := []string{table.dPath, table.bPath, table.jPath}
+	// Tables written before the table builder left their uncompressed file
+	// beside the zipped one.
+	if strings.HasSuffix(table.dPath, ".gz") {
+		paths = append(paths, strings.TrimSuffix(table.dPath, ".gz")+".bin")
+	}
+	var reclaimed int64
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if err = os.Remove(path); err != nil {
+			log.Printf("Remove obsolete ssTable file error. Err: %s", err)
+			continue
+		}
+		reclaimed += info.Size()
+	}
+	log.Printf("Removed obsolete ssTable %s, reclaimed %d bytes", table.id, reclaimed)
+	StorageStats.ObsoleteTablesRemoved.Add(1)
+	StorageStats.ReclaimedBytes.Add(reclaimed)
+}
+
+// acquireTables returns the live ssTables, each with a reference the caller
+// releases with releaseTables. The caller holds the read or the write lock.
+func (storage *StorageImpl) acquireTables() []SsTable {
+	tables := append([]SsTable{}, *storage.SsTables...)
+	for i := range tables {
+		tables[i].ref()
+	}
+	return tables
+}
+
+func releaseTables(tables []SsTable) {
+	for i := range tables {
+		tables[i].unref()
+	}
+}
@@ -0,0 +1,59 @@
+package storage
+
+// NewIterator returns a merging iterator over every version in the memtables
+// and ssTables, newest first. It is created under the storage read lock and may be used
+// after the lock is released while the caller holds references to ssTables.
+func (storage *StorageImpl) NewIterator(ssTables []SsTable) Iterator {
+	iterators := []Iterator{NewMemTableIterator(storage.MemTable)}
+	for i := len(storage.flusher.immutables) - 1; i >= 0; i-- {
+		iterators = append(iterators, NewMemTableIterator(storage.flusher.immutables[i].memTable))
+	}
+	for i := len(ssTables) - 1; i >= 0; i-- {
+		iterators = append(iterators, NewSsTableIterator(&ssTables[i]))
+	}
+	return NewMergingIterator(iterators)
+}
+
+// Scan returns up to limit live entries in [start, end). An empty end means no
+// upper bound, limit <= 0 means no limit.
+func (storage *StorageImpl) Scan(start string, end string, limit int, result_channel chan<- []KeyValue, getFunctionErr_channel chan<- error) {
+	storage.scan(start, end, limit, MaxSeq, result_channel, getFunctionErr_channel)
+}
+
+// scan is Scan of the newest versions with a sequence number not above seq.
+func (storage *StorageImpl) scan(start string, end string, limit int, seq uint64, result_channel chan<- []KeyValue, getFunctionErr_channel chan<- error) {
+	storage.Mutex.RLock()
+	ssTables := storage.acquireTables()
+	it := NewSnapshotIterator(storage.NewIterator(ssTables), seq)
+	storage.Mutex.RUnlock()
+	defer releaseTables(ssTables)
+	defer it.Close()
+	result := make([]KeyValue, 0)
+	for ok := it.Seek(start); ok && (end == "" || it.Key() < end); ok = it.Next() {
+		if limit > 0 && len(result) == limit {
+			break
+		}
+		if !it.Deleted() {
+			result = append(result, KeyValue{Key: it.Key(), Value: it.Value()})
+		}
+	}
+	result_channel <- result
+	getFunctionErr_channel <- it.Err()
+}
+
+func (storage *StorageImpl) PrefixScan(prefix string, limit int, result_channel chan<- []KeyValue, getFunctionErr_channel chan<- error) {
+	storage.Scan(prefix, PrefixEnd(prefix), limit, result_channel, getFunctionErr_channel)
+}
+
+// PrefixEnd returns the smallest key greater than every key with the prefix,
+// or "" if there is none.
+func PrefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// A scan reads the newest live version of every key in [start, end) from the
+// MemTable and the tables alike, skipping deleted keys.
+func TestScanRanges(t *testing.T) {
+	storage := newTestStorage(t, 1<<20, 100)
+	// key00..key19 go to an old table, the odd keys are overwritten in a newer
+	// one, every third key is deleted in the MemTable.
+	for i := 0; i < 20; i++ {
+		if err := testSet(storage, fmt.Sprintf("key%02d", i), "old"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testFlush(t, storage)
+	for i := 1; i < 20; i += 2 {
+		if err := testSet(storage, fmt.Sprintf("key%02d", i), "new"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testFlush(t, storage)
+	for i := 0; i < 20; i += 3 {
+		if err := testDelete(storage, fmt.Sprintf("key%02d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range []string{"a", "key", "key05x", "kez"} {
+		if err := testSet(storage, key, "mem"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// live returns the keys of key00..key19 in [from, to) that are not deleted.
+	live := func(from int, to int) []KeyValue {
+		keyValues := make([]KeyValue, 0)
+		for i := from; i < to; i++ {
+			if i%3 == 0 {
+				continue
+			}
+			value := "old"
+			if i%2 == 1 {
+				value = "new"
+			}
+			keyValues = append(keyValues, KeyValue{Key: fmt.Sprintf("key%02d", i), Value: value})
+			if i == 5 {
+				keyValues = append(keyValues, KeyValue{Key: "key05x", Value: "mem"})
+			}
+		}
+		return keyValues
+	}
+
+	tests := []struct {
+		name  string
+		start string
+		end   string
+		limit int
+		want  []KeyValue
+	}{
+		{"whole range", "", "", 0, append(append([]KeyValue{{Key: "a", Value: "mem"}, {Key: "key", Value: "mem"}}, live(0, 20)...), KeyValue{Key: "kez", Value: "mem"})},
+		{"start is inclusive", "key04", "key08", 0, live(4, 8)},
+		{"end is exclusive", "key04", "key07", 0, live(4, 7)},
+		{"bounds between keys", "key040", "key070", 0, live(5, 8)},
+		{"deleted start", "key06", "key09", 0, live(7, 9)},
+		{"limit", "key01", "", 3, live(1, 5)[:3]},
+		{"limit over the range", "key10", "key12", 10, live(10, 12)},
+		{"only deleted keys", "key09", "key10", 0, []KeyValue{}},
+		{"empty range", "key08", "key08", 0, []KeyValue{}},
+		{"start after end", "key09", "key01", 0, []KeyValue{}},
+		{"past the last key", "l", "", 0, []KeyValue{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keyValues, err := testScan(storage, test.start, test.end, test.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(keyValues, test.want) {
+				t.Fatalf("scan of [%q, %q) read %+v, want %+v", test.start, test.end, keyValues, test.want)
+			}
+		})
+	}
+}
+
+func TestPrefixScan(t *testing.T) {
+	storage := newTestStorage(t, 1<<20, 100)
+	for _, key := range []string{"ab", "abc", "abd", "abd\xff", "ab\xff", "ab\xff\xff", "ac", "b", "\xff", "\xff\xffa"} {
+		if err := testSet(storage, key, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testFlush(t, storage)
+	if err := testDelete(storage, "abd"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"ab", []string{"ab", "abc", "abd\xff", "ab\xff", "ab\xff\xff"}},
+		{"abd", []string{"abd\xff"}},
+		{"ab\xff", []string{"ab\xff", "ab\xff\xff"}},
+		{"\xff", []string{"\xff", "\xff\xffa"}},
+		{"\xff\xff", []string{"\xff\xffa"}},
+		{"x", []string{}},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%q", test.prefix), func(t *testing.T) {
+			resultChan, errChan := make(chan []KeyValue, 1), make(chan error, 1)
+			storage.PrefixScan(test.prefix, 0, resultChan, errChan)
+			keyValues, err := <-resultChan, <-errChan
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys := make([]string, 0, len(keyValues))
+			for _, keyValue := range keyValues {
+				keys = append(keys, keyValue.Key)
+			}
+			if !reflect.DeepEqual(keys, test.want) {
+				t.Fatalf("prefix scan read %q, want %q", keys, test.want)
+			}
+		})
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"", ""},
+		{"a", "b"},
+		{"abc", "abd"},
+		{"a\xff", "b"},
+		{"a\xff\xff", "b"},
+		{"\xff", ""},
+		{"\xff\xff", ""},
+	}
+	for _, test := range tests {
+		if end := PrefixEnd(test.prefix); end != test.want {
+			t.Errorf("PrefixEnd(%q) = %q, want %q", test.prefix, end, test.want)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+// CompactionScheduler runs compactions every period and on demand. Pausing it
+// stops the periodic runs only, so a paused storage can still be compacted by
+// an explicit trigger, e.g. right after a bulk load.
+type CompactionScheduler struct {
+	mutex   sync.Mutex
+	period  time.Duration
+	paused  bool
+	running bool
+	runs    int64
+	lastRun time.Time
+	// waiters are closed once the next run finishes.
+	waiters []chan struct{}
+	kick    chan struct{}
+}
+
+// CompactionState describes the scheduler for the admin endpoints.
+type CompactionState struct {
+	Paused    bool   `json:"paused"`
+	Running   bool   `json:"running"`
+	PeriodSec int    `json:"period_sec"`
+	Runs      int64  `json:"runs"`
+	LastRun   string `json:"last_run"`
+}
+
+// NewCompactionScheduler returns a scheduler running every period. A period
+// that is not positive disables the periodic runs.
+func NewCompactionScheduler(period time.Duration) *CompactionScheduler {
+	return &CompactionScheduler{period: period, kick: make(chan struct{}, 1)}
+}
+
+// Run calls compact until the process exits.
+func (scheduler *CompactionScheduler) Run(compact func()) {
+	var tick <-chan time.Time
+	if scheduler.period > 0 {
+		ticker := time.NewTicker(scheduler.period)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-tick:
+			scheduler.mutex.Lock()
+			paused := scheduler.paused
+			scheduler.mutex.Unlock()
+			if paused {
+				continue
+			}
+		case <-scheduler.kick:
+		}
+
+		scheduler.mutex.Lock()
+		waiters := scheduler.waiters
+		scheduler.waiters = nil
+		scheduler.running = true
+		scheduler.mutex.Unlock()
+
+		compact()
+
+		scheduler.mutex.Lock()
+		scheduler.running = false
+		scheduler.runs++
+		scheduler.lastRun = time.Now()
+		scheduler.mutex.Unlock()
+		for _, waiter := range waiters {
+			close(waiter)
+		}
+	}
+}
+
+func (scheduler *CompactionScheduler) Pause() {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	scheduler.paused = true
+}
+
+func (scheduler *CompactionScheduler) Resume() {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	scheduler.paused = false
+}
+
+// Trigger requests a run. The returned channel is closed once a run started
+// after the request finishes. Requests made while a run is pending share it.
+func (scheduler *CompactionScheduler) Trigger() <-chan struct{} {
+	done := make(chan struct{})
+	scheduler.mutex.Lock()
+	scheduler.waiters = append(scheduler.waiters, done)
+	scheduler.mutex.Unlock()
+	select {
+	case scheduler.kick <- struct{}{}:
+	default:
+	}
+	return done
+}
+
+func (scheduler *CompactionScheduler) State() CompactionState {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	state := CompactionState{
+		Paused:    scheduler.paused,
+		Running:   scheduler.running,
+		PeriodSec: int(scheduler.period / time.Second),
+		Runs:      scheduler.runs,
+	}
+	if !scheduler.lastRun.IsZero() {
+		state.LastRun = scheduler.lastRun.Format(time.RFC3339)
+	}
+	return state
+}
+
+func (storage *StorageImpl) PauseCompaction(state_channel chan<- CompactionState) {
+	storage.Scheduler.Pause()
+	state_channel <- storage.Scheduler.State()
+}
+
+func (storage *StorageImpl) ResumeCompaction(state_channel chan<- CompactionState) {
+	storage.Scheduler.Resume()
+	state_channel <- storage.Scheduler.State()
+}
+
+// TriggerCompaction requests a compaction run. With wait set it reports the
+// state after the run, otherwise right away.
+func (storage *StorageImpl) TriggerCompaction(wait bool, state_channel chan<- CompactionState) {
+	done := storage.Scheduler.Trigger()
+	if wait {
+		<-done
+	}
+	state_channel <- storage.Scheduler.State()
+}
+
+func (storage *StorageImpl) CompactionStatus(state_channel chan<- CompactionState) {
+	state_channel <- storage.Scheduler.State()
+}
@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Level zero is no compression, a spec without a level compresses at the
+// default level of the codec.
+func TestParseCodecLevel(t *testing.T) {
+	segment := bytes.Repeat([]byte("key:value;"), 1000)
+	tests := []struct {
+		spec       string
+		compressed bool
+	}{
+		{"gzip", true},
+		{"gzip:0", false},
+		{"gzip:1", true},
+		{"gzip:-1", true},
+		{"deflate", true},
+		{"deflate:0", false},
+		{"zlib", true},
+		{"zlib:0", false},
+		{"none", false},
+	}
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			codec, err := ParseCodec(test.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := codec.Zip(segment)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if compressed := len(data) < len(segment)/2; compressed != test.compressed {
+				t.Fatalf("%s wrote %d of %d bytes, want compressed %v", test.spec, len(data), len(segment), test.compressed)
+			}
+			unzipped, err := codec.Unzip(&data)
+			if err != nil || !bytes.Equal(unzipped, segment) {
+				t.Fatalf("unzip changed the segment, err %v", err)
+			}
+		})
+	}
+}
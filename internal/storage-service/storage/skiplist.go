@@ -0,0 +1,219 @@
+package storage
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"unsafe"
+)
+
+const (
+	skipListMaxHeight = 20
+	// skipListBranching is the inverse probability of a node reaching the
+	// next level.
+	skipListBranching = 4
+)
+
+// SkipListMemTable is a lock-free MemTable. Nodes are never removed, deletes
+// store tombstones, so an insert only has to link a new node with
+// compare-and-swap at every level, bottom up. A node is part of the table once
+// it is linked at level 0; the upper levels only speed searches up. A write to
+// an existing key atomically pushes a new version in front of the older ones.
+type SkipListMemTable struct {
+	head    *skipNode
+	height  atomic.Int32
+	length  atomic.Int64
+	size    atomic.Int64
+	maxSize uintptr
+}
+
+type skipNode struct {
+	key   string
+	entry atomic.Pointer[Entry]
+	next  []atomic.Pointer[skipNode]
+}
+
+var (
+	skipNodeOverhead = unsafe.Sizeof(skipNode{}) + entrySize
+	skipLinkSize     = unsafe.Sizeof(atomic.Pointer[skipNode]{})
+)
+
+func NewSkipListMemTable(maxSize uintptr) *SkipListMemTable {
+	memTable := &SkipListMemTable{
+		head:    &skipNode{next: make([]atomic.Pointer[skipNode], skipListMaxHeight)},
+		maxSize: maxSize,
+	}
+	memTable.height.Store(1)
+	return memTable
+}
+
+func randomHeight() int {
+	height := 1
+	for height < skipListMaxHeight && rand.Intn(skipListBranching) == 0 {
+		height++
+	}
+	return height
+}
+
+func (memTable *SkipListMemTable) Add(key string, value string, seq uint64) error {
+	return memTable.put(key, Entry{Value: value, Seq: seq})
+}
+
+func (memTable *SkipListMemTable) Delete(key string, seq uint64) error {
+	return memTable.put(key, Entry{Deleted: true, Seq: seq})
+}
+
+func (memTable *SkipListMemTable) put(key string, entry Entry) error {
+	var preds, succs [skipListMaxHeight]*skipNode
+	for {
+		memTable.findSplice(key, &preds, &succs)
+		if found := succs[0]; found != nil && found.key == key {
+			for {
+				entry.older = found.entry.Load()
+				if found.entry.CompareAndSwap(entry.older, &entry) {
+					break
+				}
+			}
+			memTable.size.Add(int64(entrySize) + int64(len(entry.Value)))
+			return memTable.checkSize()
+		}
+
+		height := randomHeight()
+		node := &skipNode{key: key, next: make([]atomic.Pointer[skipNode], height)}
+		node.entry.Store(&entry)
+		for level := 0; level < height; level++ {
+			node.next[level].Store(succs[level])
+		}
+		if !preds[0].next[0].CompareAndSwap(succs[0], node) {
+			// Another insert got between the neighbours, search again.
+			continue
+		}
+		for level := 1; level < height; level++ {
+			for !preds[level].next[level].CompareAndSwap(succs[level], node) {
+				preds[level], succs[level] = memTable.findLevel(preds[level], key, level)
+				node.next[level].Store(succs[level])
+			}
+		}
+		for current := memTable.height.Load(); int32(height) > current; current = memTable.height.Load() {
+			if memTable.height.CompareAndSwap(current, int32(height)) {
+				break
+			}
+		}
+		memTable.length.Add(1)
+		memTable.size.Add(int64(skipNodeOverhead + uintptr(height)*skipLinkSize + uintptr(len(key)) + uintptr(len(entry.Value))))
+		return memTable.checkSize()
+	}
+}
+
+func (memTable *SkipListMemTable) checkSize() error {
+	if uintptr(memTable.size.Load()) >= memTable.maxSize {
+		return ErrMemTableFull
+	}
+	return nil
+}
+
+// findSplice fills preds and succs with the nodes around key on every level:
+// preds[level].key < key <= succs[level].key.
+func (memTable *SkipListMemTable) findSplice(key string, preds *[skipListMaxHeight]*skipNode, succs *[skipListMaxHeight]*skipNode) {
+	pred := memTable.head
+	for level := skipListMaxHeight - 1; level >= 0; level-- {
+		preds[level], succs[level] = memTable.findLevel(pred, key, level)
+		pred = preds[level]
+	}
+}
+
+// findLevel walks level from start, which must precede key, to the nodes
+// around key.
+func (memTable *SkipListMemTable) findLevel(start *skipNode, key string, level int) (*skipNode, *skipNode) {
+	pred := start
+	for {
+		next := pred.next[level].Load()
+		if next == nil || next.key >= key {
+			return pred, next
+		}
+		pred = next
+	}
+}
+
+// seek returns the first node with a key not less than key.
+func (memTable *SkipListMemTable) seek(key string) *skipNode {
+	pred := memTable.head
+	var next *skipNode
+	for level := int(memTable.height.Load()) - 1; level >= 0; level-- {
+		pred, next = memTable.findLevel(pred, key, level)
+	}
+	return next
+}
+
+func (memTable *SkipListMemTable) Find(key string, seq uint64) (string, error) {
+	node := memTable.seek(key)
+	if node == nil || node.key != key {
+		return "", ErrKeyNotFound
+	}
+	entry := node.entry.Load().find(seq)
+	if entry == nil {
+		return "", ErrKeyNotFound
+	}
+	if entry.Deleted {
+		return "", ErrKeyDeleted
+	}
+	return entry.Value, nil
+}
+
+func (memTable *SkipListMemTable) Len() int {
+	return int(memTable.length.Load())
+}
+
+func (memTable *SkipListMemTable) Size() uintptr {
+	return uintptr(memTable.size.Load())
+}
+
+func (memTable *SkipListMemTable) MaxSize() uintptr {
+	return memTable.maxSize
+}
+
+func (memTable *SkipListMemTable) NewEmpty() MemTable {
+	return NewSkipListMemTable(memTable.maxSize)
+}
+
+// NewIterator returns an iterator that may run alongside writes. Keys inserted
+// while iterating may or may not be seen.
+func (memTable *SkipListMemTable) NewIterator() Iterator {
+	return &skipListIterator{memTable: memTable}
+}
+
+type skipListIterator struct {
+	memTable *SkipListMemTable
+	node     *skipNode
+	entry    *Entry
+}
+
+func (it *skipListIterator) Seek(key string) bool {
+	it.set(it.memTable.seek(key))
+	return it.node != nil
+}
+
+func (it *skipListIterator) Next() bool {
+	if it.node == nil {
+		return false
+	}
+	if it.entry.older != nil {
+		it.entry = it.entry.older
+		return true
+	}
+	it.set(it.node.next[0].Load())
+	return it.node != nil
+}
+
+func (it *skipListIterator) set(node *skipNode) {
+	it.node = node
+	if node != nil {
+		it.entry = node.entry.Load()
+	}
+}
+
+func (it *skipListIterator) Key() string   { return it.node.key }
+func (it *skipListIterator) Value() string { return it.entry.Value }
+func (it *skipListIterator) Deleted() bool { return it.entry.Deleted }
+func (it *skipListIterator) Seq() uint64   { return it.entry.Seq }
+func (it *skipListIterator) Err() error    { return nil }
+func (it *skipListIterator) Close() error  { return nil }
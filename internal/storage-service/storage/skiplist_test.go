@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// Concurrent writers insert overlapping keys while readers find and iterate.
+// Like the storage, a writer takes its sequence number and writes under the
+// lock of the key, so the versions of a key arrive in sequence order. Run it
+// with -race.
+func TestSkipListConcurrentInsert(t *testing.T) {
+	const writers, writes, keys, keyLocks = 8, 2000, 500, 16
+	memTable := NewSkipListMemTable(1 << 30)
+	var seq atomic.Uint64
+	var locks [keyLocks]sync.Mutex
+	// last holds the newest write of every key, versions its number of writes.
+	last := make([]KeyValue, keys)
+	versions := make([]int, keys)
+
+	var writersDone sync.WaitGroup
+	for writer := 0; writer < writers; writer++ {
+		writersDone.Add(1)
+		go func(writer int) {
+			defer writersDone.Done()
+			for i := 0; i < writes; i++ {
+				k := (i*31 + writer*7) % keys
+				key := fmt.Sprintf("key%04d", k)
+				locks[k%keyLocks].Lock()
+				write := KeyValue{Key: key, Seq: seq.Add(1)}
+				var err error
+				if i%13 == 0 {
+					write.Deleted = true
+					err = memTable.Delete(key, write.Seq)
+				} else {
+					write.Value = fmt.Sprintf("writer%d-%d", writer, i)
+					err = memTable.Add(key, write.Value, write.Seq)
+				}
+				last[k] = write
+				versions[k]++
+				locks[k%keyLocks].Unlock()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(writer)
+	}
+	stop := make(chan struct{})
+	var readersDone sync.WaitGroup
+	for reader := 0; reader < 2; reader++ {
+		readersDone.Add(1)
+		go func() {
+			defer readersDone.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				memTable.Find("key0250", MaxSeq)
+				it := memTable.NewIterator()
+				previous := ""
+				for ok := it.Seek(""); ok; ok = it.Next() {
+					if it.Key() < previous {
+						t.Errorf("iterator went back from %q to %q", previous, it.Key())
+						return
+					}
+					previous = it.Key()
+				}
+			}
+		}()
+	}
+	writersDone.Wait()
+	close(stop)
+	readersDone.Wait()
+
+	if memTable.Len() != keys {
+		t.Fatalf("Len is %d, want %d", memTable.Len(), keys)
+	}
+	it := memTable.NewIterator()
+	k := -1
+	var previous KeyValue
+	count := 0
+	for ok := it.Seek(""); ok; ok = it.Next() {
+		current := KeyValue{Key: it.Key(), Value: it.Value(), Deleted: it.Deleted(), Seq: it.Seq()}
+		if current.Key != previous.Key || k < 0 {
+			if k >= 0 && count != versions[k] {
+				t.Fatalf("%s has %d versions, want %d", previous.Key, count, versions[k])
+			}
+			k++
+			if current != last[k] {
+				t.Fatalf("newest version of key %d is %+v, want %+v", k, current, last[k])
+			}
+			count = 0
+		} else if current.Seq >= previous.Seq {
+			t.Fatalf("versions of %s are out of order: seq %d after %d", current.Key, current.Seq, previous.Seq)
+		}
+		previous = current
+		count++
+	}
+	if k != keys-1 || count != versions[k] {
+		t.Fatalf("iterated %d keys, the last with %d versions", k+1, count)
+	}
+	for _, write := range last {
+		value, err := memTable.Find(write.Key, MaxSeq)
+		if write.Deleted {
+			if !errors.Is(err, ErrKeyDeleted) {
+				t.Fatalf("%s reads as %q, %v, want deleted", write.Key, value, err)
+			}
+		} else if err != nil || value != write.Value {
+			t.Fatalf("%s reads as %q, %v, want %q", write.Key, value, err, write.Value)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"sync/atomic"
+)
+
+var ErrSnapshotReleased = errors.New("snapshot was released")
+
+// Snapshot is a point-in-time view of the storage. Its reads see every write
+// acknowledged before it was taken and none made after, while writes, flushes
+// and compaction go on: they keep the versions a live snapshot may read. A
+// snapshot holds on to those versions until it is released.
+type Snapshot struct {
+	storage  *StorageImpl
+	seq      uint64
+	released atomic.Bool
+}
+
+// Snapshot takes a snapshot of the writes applied so far. The write lock waits
+// for the writes in flight, so every sequence number up to the snapshot is in
+// a MemTable or an ssTable.
+func (storage *StorageImpl) Snapshot(snapshot_channel chan<- *Snapshot) {
+	storage.Mutex.Lock()
+	defer storage.Mutex.Unlock()
+	snapshot := &Snapshot{storage: storage, seq: storage.Wal.LastSeq()}
+	if storage.snapshots == nil {
+		storage.snapshots = make(map[uint64]int)
+	}
+	storage.snapshots[snapshot.seq]++
+	StorageStats.Snapshots.Add(1)
+	snapshot_channel <- snapshot
+}
+
+// liveSnapshots returns the sequence numbers of the live snapshots in
+// ascending order. The caller holds the read or the write lock.
+func (storage *StorageImpl) liveSnapshots() []uint64 {
+	snapshots := make([]uint64, 0, len(storage.snapshots))
+	for seq := range storage.snapshots {
+		snapshots = append(snapshots, seq)
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i] < snapshots[j] })
+	return snapshots
+}
+
+// Seq is the sequence number of the last write the snapshot sees.
+func (snapshot *Snapshot) Seq() uint64 {
+	return snapshot.seq
+}
+
+func (snapshot *Snapshot) Get(key string, value_channel chan<- string, getFunctionErr_channel chan<- error) {
+	if snapshot.released.Load() {
+		value_channel <- ""
+		getFunctionErr_channel <- ErrSnapshotReleased
+		return
+	}
+	snapshot.storage.get(key, snapshot.seq, value_channel, getFunctionErr_channel)
+}
+
+func (snapshot *Snapshot) Scan(start string, end string, limit int, result_channel chan<- []KeyValue, getFunctionErr_channel chan<- error) {
+	if snapshot.released.Load() {
+		result_channel <- make([]KeyValue, 0)
+		getFunctionErr_channel <- ErrSnapshotReleased
+		return
+	}
+	snapshot.storage.scan(start, end, limit, snapshot.seq, result_channel, getFunctionErr_channel)
+}
+
+func (snapshot *Snapshot) PrefixScan(prefix string, limit int, result_channel chan<- []KeyValue, getFunctionErr_channel chan<- error) {
+	snapshot.Scan(prefix, PrefixEnd(prefix), limit, result_channel, getFunctionErr_channel)
+}
+
+// Release lets flushes and compaction drop the versions only the snapshot
+// reads. Releasing a snapshot twice is a no-op.
+func (snapshot *Snapshot) Release() {
+	if snapshot.released.Swap(true) {
+		return
+	}
+	storage := snapshot.storage
+	storage.Mutex.Lock()
+	defer storage.Mutex.Unlock()
+	if storage.snapshots[snapshot.seq]--; storage.snapshots[snapshot.seq] <= 0 {
+		delete(storage.snapshots, snapshot.seq)
+	}
+	StorageStats.Snapshots.Add(-1)
+	log.Printf("Released snapshot at sequence number %d", snapshot.seq)
+}
+
+// compactVersions passes on the versions of it that a reader may still see:
+// of every key the newest version and the newest version each snapshot sees.
+// snapshots are sorted in ascending order. With dropTombstones set, no older
+// table holds the keys, so tombstones that are the oldest version kept are
+// dropped as well.
+func compactVersions(it Iterator, snapshots []uint64, dropTombstones bool, emit func(KeyValue) error) error {
+	versions := make([]KeyValue, 0)
+	flush := func() error {
+		for _, keyValue := range keepVersions(versions, snapshots, dropTombstones) {
+			if err := emit(keyValue); err != nil {
+				return err
+			}
+		}
+		versions = versions[:0]
+		return nil
+	}
+	for ok := it.Seek(""); ok; ok = it.Next() {
+		if len(versions) != 0 && versions[0].Key != it.Key() {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		versions = append(versions, KeyValue{Key: it.Key(), Value: it.Value(), Deleted: it.Deleted(), Seq: it.Seq()})
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	return flush()
+}
+
+// keepVersions filters the versions of a key, newest first. A version is read
+// by the snapshots from its sequence number up to that of the next newer one.
+func keepVersions(versions []KeyValue, snapshots []uint64, dropTombstones bool) []KeyValue {
+	if len(versions) == 0 {
+		return versions
+	}
+	kept := []KeyValue{versions[0]}
+	for i := 1; i < len(versions); i++ {
+		from, to := versions[i].Seq, versions[i-1].Seq
+		j := sort.Search(len(snapshots), func(j int) bool { return snapshots[j] >= from })
+		if j < len(snapshots) && snapshots[j] < to {
+			kept = append(kept, versions[i])
+		}
+	}
+	for dropTombstones && len(kept) != 0 && kept[len(kept)-1].Deleted {
+		kept = kept[:len(kept)-1]
+	}
+	return kept
+}
@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func testSnapshot(storage *StorageImpl) *Snapshot {
+	snapshotChan := make(chan *Snapshot, 1)
+	storage.Snapshot(snapshotChan)
+	return <-snapshotChan
+}
+
+func testSnapshotGet(snapshot *Snapshot, key string) (string, error) {
+	valueChan, errChan := make(chan string, 1), make(chan error, 1)
+	snapshot.Get(key, valueChan, errChan)
+	return <-valueChan, <-errChan
+}
+
+func testSnapshotScan(snapshot *Snapshot, start string, end string) ([]KeyValue, error) {
+	resultChan, errChan := make(chan []KeyValue, 1), make(chan error, 1)
+	snapshot.Scan(start, end, 0, resultChan, errChan)
+	return <-resultChan, <-errChan
+}
+
+// useMerger makes the storage compact its tables with the strategy, "merge",
+// "leveled" or "tiered", tuned so that a few flushes start a compaction.
+func useMerger(storage *StorageImpl, strategy string) {
+	base := storage.Merger.(*MergerImpl)
+	var merger *MergerImpl
+	switch strategy {
+	case "leveled":
+		leveled := &LeveledMerger{L0CompactionTrigger: 2, BaseLevelSize: 1000, LevelSizeMultiplier: 3, MaxLevels: 4}
+		merger, storage.Merger = &leveled.MergerImpl, leveled
+	case "tiered":
+		tiered := &SizeTieredMerger{MinThreshold: 2, MaxThreshold: 8, BucketLow: 0.5, BucketHigh: 1.5, MinTableSize: 1}
+		merger, storage.Merger = &tiered.MergerImpl, tiered
+	default:
+		return
+	}
+	merger.MemNewFileLimit = base.MemNewFileLimit
+	merger.StorageSstDirPath = base.StorageSstDirPath
+	merger.SsTableSegmentLength = base.SsTableSegmentLength
+	merger.BloomBitsPerKey = base.BloomBitsPerKey
+}
+
+// tableVersions counts the versions stored in the tables of the storage.
+func tableVersions(t *testing.T, storage *StorageImpl) int {
+	t.Helper()
+	count := 0
+	for _, table := range *storage.SsTables {
+		keyValues, err := DumpTable(table.dPath, "", "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		count += len(keyValues)
+	}
+	return count
+}
+
+// A snapshot reads the values written before it while the keys are
+// overwritten and deleted, flushed and compacted by every strategy.
+func TestSnapshotReadsAcrossFlushAndCompaction(t *testing.T) {
+	for _, strategy := range []string{"merge", "leveled", "tiered"} {
+		t.Run(strategy, func(t *testing.T) {
+			storage := newTestStorage(t, 400, 60)
+			useMerger(storage, strategy)
+			for i := 0; i < 50; i++ {
+				if err := testSet(storage, fmt.Sprintf("key%02d", i), "old"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			snapshot := testSnapshot(storage)
+			defer snapshot.Release()
+			for round := 0; round < 5; round++ {
+				for i := 0; i < 50; i++ {
+					var err error
+					if key := fmt.Sprintf("key%02d", i); i%7 == 0 {
+						err = testDelete(storage, key)
+					} else {
+						err = testSet(storage, key, fmt.Sprintf("new%d", round))
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := testSet(storage, fmt.Sprintf("late%d", round), "late"); err != nil {
+					t.Fatal(err)
+				}
+				waitFlushed(storage)
+				storage.compact()
+				storage.compact()
+			}
+			if len(*storage.SsTables) == 0 {
+				t.Fatal("nothing was flushed")
+			}
+
+			for i := 0; i < 50; i++ {
+				key := fmt.Sprintf("key%02d", i)
+				if value, err := testSnapshotGet(snapshot, key); err != nil || value != "old" {
+					t.Fatalf("snapshot reads %s as %q, %v, want old", key, value, err)
+				}
+				value, err := testGet(storage, key)
+				if i%7 == 0 {
+					if !errors.Is(err, ErrKeyNotFound) {
+						t.Fatalf("deleted %s reads as %q, %v", key, value, err)
+					}
+				} else if err != nil || value != "new4" {
+					t.Fatalf("%s reads as %q, %v, want new4", key, value, err)
+				}
+			}
+			if value, err := testSnapshotGet(snapshot, "late0"); !errors.Is(err, ErrKeyNotFound) {
+				t.Fatalf("snapshot reads a later write as %q, %v", value, err)
+			}
+			keyValues, err := testSnapshotScan(snapshot, "", "")
+			if err != nil || len(keyValues) != 50 {
+				t.Fatalf("snapshot scan read %d entries, %v, want 50", len(keyValues), err)
+			}
+			for _, keyValue := range keyValues {
+				if keyValue.Value != "old" {
+					t.Fatalf("snapshot scan read %+v", keyValue)
+				}
+			}
+		})
+	}
+}
+
+// A released snapshot reads nothing and its versions are dropped by the next
+// compaction.
+func TestSnapshotRelease(t *testing.T) {
+	storage := newTestStorage(t, 400, 60)
+	for i := 0; i < 20; i++ {
+		if err := testSet(storage, fmt.Sprintf("key%02d", i), "old"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snapshot := testSnapshot(storage)
+	second := testSnapshot(storage)
+	for i := 0; i < 20; i++ {
+		if err := testSet(storage, fmt.Sprintf("key%02d", i), "new"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Push the MemTable out, so every version is in a table.
+	for i := 0; i < 20; i++ {
+		if err := testSet(storage, fmt.Sprintf("other%02d", i), "x"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFlushed(storage)
+	storage.compact()
+	held := tableVersions(t, storage)
+	if held != 60 {
+		t.Fatalf("compaction kept %d versions, want 60 with the snapshots live", held)
+	}
+
+	snapshot.Release()
+	snapshot.Release()
+	if value, err := testSnapshotGet(snapshot, "key00"); !errors.Is(err, ErrSnapshotReleased) {
+		t.Fatalf("released snapshot reads %q, %v", value, err)
+	}
+	if _, err := testSnapshotScan(snapshot, "", ""); !errors.Is(err, ErrSnapshotReleased) {
+		t.Fatalf("released snapshot scans with %v", err)
+	}
+	if value, err := testSnapshotGet(second, "key00"); err != nil || value != "old" {
+		t.Fatalf("snapshot taken at the same seq reads %q, %v after the other is released", value, err)
+	}
+	storage.compact()
+	if versions := tableVersions(t, storage); versions != held {
+		t.Fatalf("compaction kept %d versions of %d with a snapshot still live", versions, held)
+	}
+
+	second.Release()
+	if len(storage.snapshots) != 0 {
+		t.Fatalf("snapshots %v are live after the release", storage.snapshots)
+	}
+	storage.compact()
+	if versions := tableVersions(t, storage); versions != 40 {
+		t.Fatalf("compaction kept %d versions after the release, want 40", versions)
+	}
+	for i := 0; i < 20; i++ {
+		if value, err := testGet(storage, fmt.Sprintf("key%02d", i)); err != nil || value != "new" {
+			t.Fatalf("key%02d reads as %q, %v after the release", i, value, err)
+		}
+	}
+}
@@ -1,15 +1,18 @@
 package storage
 
 import (
-	"bufio"
 	"errors"
 	"fmt"
 	"github.com/google/uuid"
-	"gopkg.in/OlexiyKhokhlov/avltree.v2"
+	"hash/crc32"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 type SparseIndices struct {
@@ -18,261 +21,353 @@ type SparseIndices struct {
 }
 
 type SsTable struct {
-	dPath  string
-	jPath  string
-	segLen int64
-	ind    map[string]SparseIndices
-	id     uuid.UUID
+	dPath           string
+	jPath           string
+	bPath           string
+	segLen          int64
+	ind             SparseIndex
+	id              uuid.UUID
+	format          segmentFormat
+	bloom           *BloomFilter
+	bloomBitsPerKey int
+	cache           *BlockCache
+	level           int
+	// last holds the last key of the table, see lastKey.
+	last *tableLastKey
+	size int64
+	// smallestSeq and largestSeq bound the sequence numbers of the writes
+	// the table holds.
+	smallestSeq uint64
+	largestSeq  uint64
+	refs        *atomic.Int64
+	// corrupt is the ErrCorruption of a table whose index could not be read.
+	corrupt error
+	// codec compresses the segments of a new table. Segments are read with the
+	// codec their index entry records.
+	codec Zip
+	// textChunks are the gzip chunks of a table in the text format, see
+	// decodeTextTable. Such a table is indexed as a single segment.
+	textChunks SparseIndex
+	// segmentsEnd is the offset where the segments end and the index block,
+	// if any, starts.
+	segmentsEnd int64
 }
 
-func (table *SsTable) Init(mt MemTable) error {
-	var currSize int64
-	var segCount int64
-	file, err := os.OpenFile(table.dPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+// Init writes the MemTable to the table file. Older versions of a key are
+// kept only for the snapshots that read them.
+func (table *SsTable) Init(mt MemTable, snapshots []uint64) error {
+	builder, err := newTableBuilder(table)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if err = file.Close(); err != nil {
-			log.Printf("Close sstable file error. Err: %s", err)
-		}
-	}()
-	err = nil
-	isFirst := true
-	mt.AvlTree.Enumerate(avltree.ASCENDING, func(key string, value string) bool {
-		line := ";" + key + ":" + value
-		if isFirst {
-			line = key + ":" + value
-			isFirst = false
-		}
-		data := []byte(line)
-		dataSize := (int64)(len(data))
-		if dataSize > table.segLen {
-			err = errors.New("segments of SSTable are too small to fit the key-value")
-			return false
-		}
-		if currSize+dataSize > table.segLen {
-			currSize = 0
-			segCount += 1
-		}
-		if currSize == 0 {
-			table.ind[key] = SparseIndices{segCount * table.segLen, segCount*table.segLen + table.segLen}
-		}
-		bytesCount, writeError := file.Write(data)
-		if writeError != nil {
-			log.Printf("Write data in sstable file error. Err: %s", writeError)
-			err = writeError
-			return false
-		}
-		currSize += (int64)(bytesCount)
-		return true
-	})
-	var zipper Zip
-	zipper = GZip{}
-	table.dPath, table.ind, table.segLen = zipper.Zip(table.dPath, &table.ind, table.segLen)
+	it := mt.NewIterator()
+	defer it.Close()
+	if err = compactVersions(it, snapshots, false, builder.add); err != nil {
+		builder.abandon()
+		return err
+	}
+	if err = builder.finish(); err != nil {
+		log.Printf("Write sstable error. Err: %s", err)
+		builder.abandon()
+		return err
+	}
+	return nil
+}
 
-	journal, err := os.OpenFile(table.jPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+// InitFromSlice writes the entries, sorted by key and the versions of a key
+// newest first, to the table file.
+func (table *SsTable) InitFromSlice(keyValue []KeyValue) error {
+	builder, err := newTableBuilder(table)
 	if err != nil {
-		log.Printf("Open journal error. Err: %s", err)
+		return err
 	}
-	defer func() {
-		if err = journal.Close(); err != nil {
-			log.Printf("Close journal error. Err: %s", err)
-		}
-	}()
-	for keyTable := range table.ind {
-		start := table.ind[keyTable].start
-		end := table.ind[keyTable].end
-		_, err = journal.WriteString(keyTable + ":" + strconv.FormatInt(start, 10) + ":" + strconv.FormatInt(end, 10) + "\n")
-		if err != nil {
-			log.Printf("Write in journal error. Err: %s", err)
+	for _, i := range keyValue {
+		if err = builder.add(i); err != nil {
+			builder.abandon()
+			return err
 		}
 	}
+	if err = builder.finish(); err != nil {
+		log.Printf("Write sstable error. Err: %s", err)
+		builder.abandon()
+		return err
+	}
+	return nil
+}
 
-	return err
+// firstKey and lastKey bound the keys of the table. Both are empty for an
+// empty table.
+func (table *SsTable) firstKey() string {
+	if len(table.ind) == 0 {
+		return ""
+	}
+	return table.ind[0].key
 }
 
-type KeyValuePair struct {
-	Key   string
-	Value string
+// tableLastKey is the last key of a table, shared by the copies of its
+// SsTable. Tables whose index holds no last keys read it from their last
+// segment on first use rather than when they are opened.
+type tableLastKey struct {
+	mutex  sync.Mutex
+	loaded bool
+	key    string
 }
 
-func (table *SsTable) InitFromSlice(keyValue []KeyValuePair) error {
-	var currentSize int64
-	var segmentsCount int64
-	file, err := os.OpenFile(table.dPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
+func knownLastKey(key string) *tableLastKey {
+	return &tableLastKey{loaded: true, key: key}
+}
+
+func (table *SsTable) lastKey() string {
+	if table.last == nil || len(table.ind) == 0 {
+		return ""
 	}
-	defer func() {
-		if err = file.Close(); err != nil {
-			log.Printf("Close sstable file error. Err: %s", err)
-		}
-	}()
-	err = nil
-	isFirst := true
-	WriteInFile := func(key string, value string) {
-		line := ";" + key + ":" + value
-		if isFirst {
-			line = key + ":" + value
-			isFirst = false
-		}
-		data := []byte(line)
-		dataSize := (int64)(len(data))
-		if dataSize > table.segLen {
-			err = errors.New("segments of SSTable are too small to fit the key-value")
-			return
-		}
-		if currentSize+dataSize > table.segLen {
-			currentSize = 0
-			segmentsCount += 1
-		}
-		if currentSize == 0 {
-			table.ind[key] = SparseIndices{segmentsCount * table.segLen, segmentsCount*table.segLen + table.segLen}
-		}
-		bytesCount, writeError := file.Write(data)
-		if writeError != nil {
-			log.Printf("Write data in sstable file error. Err: %s", writeError)
-			err = writeError
-			return
-		}
-		currentSize += (int64)(bytesCount)
-		return
+	table.last.mutex.Lock()
+	defer table.last.mutex.Unlock()
+	if !table.last.loaded {
+		table.last.key, table.last.loaded = table.readLastKey(), true
 	}
+	return table.last.key
+}
 
-	for _, i := range keyValue {
-		WriteInFile(i.Key, i.Value)
+// readLastKey reads the last key from the last segment. For an unreadable
+// segment it falls back to the first key of the segment.
+func (table *SsTable) readLastKey() string {
+	last := len(table.ind) - 1
+	entries, err := table.readSegment(last)
+	if err != nil {
+		log.Printf("Read last segment of ssTable with id %s error. Err: %s", table.id.String(), err)
+		return table.ind[last].key
 	}
+	if len(entries) == 0 {
+		return table.ind[last].key
+	}
+	return entries[len(entries)-1].Key
+}
 
-	var zipper Zip
-	zipper = GZip{}
-	table.dPath, table.ind, table.segLen = zipper.Zip(table.dPath, &table.ind, table.segLen)
+// overlaps reports whether the table may hold keys in [first, last].
+func (table *SsTable) overlaps(first string, last string) bool {
+	return len(table.ind) != 0 && table.firstKey() <= last && table.lastKey() >= first
+}
 
-	journal, err := os.OpenFile(table.jPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
 	if err != nil {
-		log.Printf("Open journal error. Err: %s", err)
+		return 0
 	}
-	defer func() {
-		if err = journal.Close(); err != nil {
-			log.Printf("Close journal error. Err: %s", err)
+	return info.Size()
+}
+
+// Find returns the newest version of the key with a sequence number not above
+// seq. The versions of a key are never split between segments.
+func (table *SsTable) Find(key string, seq uint64) (string, error) {
+	if table.corrupt != nil {
+		return "", table.corrupt
+	}
+	if table.bloom != nil {
+		StorageStats.BloomChecks.Add(1)
+		if !table.bloom.MayContain(key) {
+			StorageStats.BloomSkipped.Add(1)
+			return "", ErrKeyNotFound
 		}
-	}()
-	for keyTable := range table.ind {
-		start := table.ind[keyTable].start
-		end := table.ind[keyTable].end
-		_, err = journal.WriteString(keyTable + ":" + strconv.FormatInt(start, 10) + ":" + strconv.FormatInt(end, 10) + "\n")
-		if err != nil {
-			log.Printf("Write in journal error. Err: %s", err)
+	}
+	segment := table.ind.Search(key)
+	if segment < 0 {
+		return "", ErrKeyNotFound
+	}
+	keyValues, err := table.readSegment(segment)
+	if err != nil {
+		return "", err
+	}
+	for _, kv := range keyValues {
+		if kv.Key == key && kv.Seq <= seq {
+			if kv.Deleted {
+				return "", ErrKeyDeleted
+			}
+			return kv.Value, nil
 		}
 	}
-
-	return err
+	log.Printf("In the ssTable with id %s key was not found", table.id.String())
+	return "", ErrKeyNotFound
 }
 
-func (table *SsTable) Find(key string) (string, error) {
-	flagLine := false
-	var neededSegmentLine int64
-	var keyLineError error
-	maxIndex := int64(0)
-	neededKey := ""
-	for keyTable := range table.ind {
-		if key < keyTable {
-			continue
-		} else {
-			if maxIndex <= table.ind[keyTable].start {
-				maxIndex = table.ind[keyTable].start
-				neededKey = keyTable
-			}
-			flagLine = true
-		}
+// readSegment reads, verifies, decompresses and decodes the segment at the
+// given index position. Damaged segments are reported as ErrCorruption.
+func (table *SsTable) readSegment(segment int) ([]KeyValue, error) {
+	if table.corrupt != nil {
+		return nil, table.corrupt
+	}
+	entry := table.ind[segment]
+	if err := table.checkSegmentBounds(entry); err != nil {
+		return nil, err
 	}
-	neededSegmentLine = maxIndex
-	if !flagLine {
-		keyLineError = errors.New(fmt.Sprintf("key %s was not found", key))
-		log.Printf("SsTable with id %s does not contain key", table.id)
-		return "", keyLineError
+	if entries, ok := table.cache.Get(table.id, entry.start); ok {
+		return entries, nil
 	}
-	var zipper Zip
-	zipper = GZip{}
 	file, err := os.OpenFile(table.dPath, os.O_RDONLY, 0644)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer func() {
 		if err = file.Close(); err != nil {
 			log.Printf("Close sstable file error. Err: %s", err)
 		}
 	}()
-	_, err = file.Seek(neededSegmentLine, 0)
+
+	data := make([]byte, entry.end-entry.start)
+	if _, err = file.ReadAt(data, entry.start); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, table.corruption(entry.start, "segment is truncated")
+		}
+		return nil, err
+	}
+	entries, size, err := table.decodeSegment(entry, data)
 	if err != nil {
-		return "", nil
+		return nil, err
 	}
+	table.cache.Put(table.id, entry.start, entries, size)
+	return entries, nil
+}
 
-	data := make([]byte, table.ind[neededKey].end-table.ind[neededKey].start)
-	n, err := file.Read(data)
+// checkSegmentBounds reports corruption when the index entry points outside the
+// segments of the table.
+func (table *SsTable) checkSegmentBounds(entry IndexEntry) error {
+	if entry.start < 0 || entry.start > entry.end || entry.end > table.segmentsEnd {
+		return table.corruption(entry.start, "segment is outside the table")
+	}
+	return nil
+}
+
+// decodeSegment verifies, decompresses and decodes the segment data of the
+// index entry. It returns the entries and the decompressed size.
+func (table *SsTable) decodeSegment(entry IndexEntry, data []byte) ([]KeyValue, int64, error) {
+	if table.textChunks != nil {
+		return table.decodeTextTable(entry, data)
+	}
+	if crc32.Checksum(data, crcTable) != entry.checksum {
+		return nil, 0, table.corruption(entry.start, "segment checksum mismatch")
+	}
+	zipper, err := NewCodec(entry.codec, DefaultLevel)
+	if err != nil {
+		return nil, 0, table.corruption(entry.start, err.Error())
+	}
+	decompressedData, err := zipper.Unzip(&data)
 	if err != nil {
-		return "", nil
-	}
-	decompressedData := zipper.Unzip(&data)
-	segment := string(decompressedData[:n])
-	value := ""
-	keyValuePairs := strings.Split(segment, ";")
-	for _, kvp := range keyValuePairs {
-		pairElements := strings.Split(kvp, ":")
-		storageKey := pairElements[0]
-		storageValue := pairElements[1]
-		if storageKey == key {
-			value = storageValue
-			return value, nil
+		return nil, 0, table.corruption(entry.start, err.Error())
+	}
+	entries, err := parseSegment(decompressedData, table.format)
+	if err != nil {
+		return nil, 0, table.corruption(entry.start, err.Error())
+	}
+	return entries, int64(len(decompressedData)), nil
+}
+
+// decodeTextTable decodes a table in the text format, data being the whole
+// table file. That format cut the record stream into gzip chunks of segLen
+// bytes regardless of record boundaries and wrote the chunks in no particular
+// order, so the chunks are joined in key order and parsed at once.
+func (table *SsTable) decodeTextTable(entry IndexEntry, data []byte) ([]KeyValue, int64, error) {
+	stream := make([]byte, 0)
+	for _, chunk := range table.textChunks {
+		if chunk.start < entry.start || chunk.start > chunk.end || chunk.end-entry.start > int64(len(data)) {
+			return nil, 0, table.corruption(chunk.start, "segment is outside the table")
+		}
+		chunkData := data[chunk.start-entry.start : chunk.end-entry.start]
+		decompressedData, err := GZip{}.Unzip(&chunkData)
+		if err != nil {
+			return nil, 0, table.corruption(chunk.start, err.Error())
 		}
+		stream = append(stream, decompressedData...)
 	}
-	log.Printf("In the ssTable with id %s key was not found", table.id.String())
-	return value, nil
+	entries, err := parseSegment(stream, textSegmentFormat)
+	if err != nil {
+		return nil, 0, table.corruption(entry.start, err.Error())
+	}
+	return entries, int64(len(stream)), nil
 }
 
+// BuildSparseIndex loads the index from the table footer. Tables written before
+// the index moved into the table file read it from their journal file.
 func (table *SsTable) BuildSparseIndex() {
-	journal, err := os.OpenFile(table.jPath, os.O_RDONLY, 0644)
+	err := table.readIndexBlock()
+	if err == nil {
+		return
+	}
+	if !errors.Is(err, errNoFooter) {
+		log.Printf("Read ssTable with id %s index error. Err: %s", table.id.String(), err)
+		var corruption *ErrCorruption
+		if errors.As(err, &corruption) {
+			table.corrupt = err
+		}
+		return
+	}
+
+	data, err := os.ReadFile(table.jPath)
 	if err != nil {
-		log.Printf("Open ssTable journal with id %s error", table.id.String())
+		log.Printf("Open ssTable journal with id %s error. Err: %s", table.id.String(), err)
 	}
-	defer func() {
-		if err = journal.Close(); err != nil {
-			log.Printf("Close sstable journal file error. Err: %s", err)
+	table.segmentsEnd = fileSize(table.dPath)
+	table.format = textSegmentFormat
+	if table.textChunks, err = table.readTextJournal(data); err != nil {
+		table.corrupt = err
+		return
+	}
+	table.ind = make(SparseIndex, 0, 1)
+	if len(table.textChunks) != 0 {
+		whole := IndexEntry{key: table.textChunks[0].key, SparseIndices: table.textChunks[0].SparseIndices}
+		for _, chunk := range table.textChunks {
+			whole.start = min(whole.start, chunk.start)
+			whole.end = max(whole.end, chunk.end)
 		}
-	}()
+		table.ind = append(table.ind, whole)
+	}
+}
 
+// readTextJournal returns the gzip chunks listed by the index journal of a
+// table in the text format. Every line of the journal is key:start:length.
+func (table *SsTable) readTextJournal(data []byte) (SparseIndex, error) {
 	index := make(map[string]SparseIndices)
-	scanner := bufio.NewScanner(journal)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line != "" {
-			sparseMap := strings.Split(line, ":")
-			start, err := strconv.ParseInt(sparseMap[1], 10, 64)
-			if err != nil {
-				fmt.Println("Error converting start index from string to int64:", err)
-				return
-			}
-			end, err := strconv.ParseInt(sparseMap[2], 10, 64)
-			if err != nil {
-				fmt.Println("Error converting end index from string to int64:", err)
-				return
-			}
-			index[sparseMap[0]] = SparseIndices{start, end}
-		} else {
+	offset := int64(0)
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
 			break
 		}
+		fields := strings.Split(line, ":")
+		if len(fields) < 3 {
+			return nil, table.journalCorruption(offset, fmt.Sprintf("index line %q is not key:start:length", line))
+		}
+		start, err := strconv.ParseInt(fields[len(fields)-2], 10, 64)
+		if err != nil {
+			return nil, table.journalCorruption(offset, fmt.Sprintf("segment start of index line %q: %s", line, err))
+		}
+		length, err := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+		if err != nil {
+			return nil, table.journalCorruption(offset, fmt.Sprintf("segment length of index line %q: %s", line, err))
+		}
+		index[strings.Join(fields[:len(fields)-2], ":")] = SparseIndices{start, start + length}
+		offset += int64(len(line)) + 1
 	}
-	if err := scanner.Err(); err != nil {
-		log.Printf("Read sstable journal file error. Err: %s", err)
-	}
-
-	table.ind = index
+	return sparseIndexFromMap(index), nil
 }
 
-func Restore(dirPath string, journalPath string, journalName string) SsTable {
-	idLen := len(journalName) - 4
-	zipPath := dirPath[:len(dirPath)-4] + ".gz"
-	ssTable := SsTable{dPath: zipPath, jPath: journalPath, id: uuid.MustParse(journalName[:idLen]), ind: make(map[string]SparseIndices)}
+// Restore opens the table stored at zipPath. journalPath is the index journal
+// of tables written before the index moved into the table file.
+func Restore(zipPath string, journalPath string, cache *BlockCache) SsTable {
+	name := filepath.Base(zipPath)
+	basePath := zipPath[:len(zipPath)-len(filepath.Ext(zipPath))]
+	bloomPath := basePath + ".bloom"
+	ssTable := SsTable{dPath: zipPath, jPath: journalPath, bPath: bloomPath, id: uuid.MustParse(name[:len(name)-len(filepath.Ext(name))]), cache: cache}
 	ssTable.BuildSparseIndex()
+	ssTable.size = fileSize(zipPath)
+	ssTable.refs = newTableRefs()
+	ssTable.last = &tableLastKey{}
+	if len(ssTable.ind) != 0 && ssTable.ind[len(ssTable.ind)-1].lastKey != "" {
+		ssTable.last = knownLastKey(ssTable.ind[len(ssTable.ind)-1].lastKey)
+	}
+	bloom, err := LoadBloomFilter(bloomPath)
+	if err == nil {
+		ssTable.bloom = bloom
+	} else if !os.IsNotExist(err) {
+		log.Printf("Discard bloom filter of ssTable with id %s. Err: %s", ssTable.id.String(), err)
+	}
 	return ssTable
 }
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Stats holds the storage counters reported by the stats endpoint.
+type Stats struct {
+	BloomChecks      atomic.Int64
+	BloomSkipped     atomic.Int64
+	BlockCacheHits   atomic.Int64
+	BlockCacheMisses atomic.Int64
+	BlockCacheSize   atomic.Int64
+
+	ImmutableMemTables atomic.Int64
+	WriteStalls        atomic.Int64
+
+	// Compaction totals over every run and the figures of the last run.
+	CompactionRuns            atomic.Int64
+	CompactionInputBytes      atomic.Int64
+	CompactionOutputBytes     atomic.Int64
+	CompactionMicros          atomic.Int64
+	LastCompactionInputBytes  atomic.Int64
+	LastCompactionOutputBytes atomic.Int64
+	LastCompactionMicros      atomic.Int64
+
+	ObsoleteTablesRemoved atomic.Int64
+	ReclaimedBytes        atomic.Int64
+
+	CorruptionErrors atomic.Int64
+
+	// Snapshots is the number of live snapshots.
+	Snapshots atomic.Int64
+}
+
+var StorageStats Stats
+
+func (stats *Stats) Snapshot() map[string]int64 {
+	return map[string]int64{
+		"bloom_checks":       stats.BloomChecks.Load(),
+		"bloom_skipped":      stats.BloomSkipped.Load(),
+		"block_cache_hits":   stats.BlockCacheHits.Load(),
+		"block_cache_misses": stats.BlockCacheMisses.Load(),
+		"block_cache_size":   stats.BlockCacheSize.Load(),
+
+		"immutable_memtables": stats.ImmutableMemTables.Load(),
+		"write_stalls":        stats.WriteStalls.Load(),
+
+		"compaction_runs":              stats.CompactionRuns.Load(),
+		"compaction_input_bytes":       stats.CompactionInputBytes.Load(),
+		"compaction_output_bytes":      stats.CompactionOutputBytes.Load(),
+		"compaction_micros":            stats.CompactionMicros.Load(),
+		"last_compaction_input_bytes":  stats.LastCompactionInputBytes.Load(),
+		"last_compaction_output_bytes": stats.LastCompactionOutputBytes.Load(),
+		"last_compaction_micros":       stats.LastCompactionMicros.Load(),
+
+		"obsolete_tables_removed": stats.ObsoleteTablesRemoved.Load(),
+		"reclaimed_bytes":         stats.ReclaimedBytes.Load(),
+
+		"corruption_errors": stats.CorruptionErrors.Load(),
+
+		"snapshots": stats.Snapshots.Load(),
+	}
+}
+
+func (storage *StorageImpl) Stats(stats_channel chan<- map[string]int64) {
+	stats_channel <- StorageStats.Snapshot()
+}
+
+// recordCompaction logs a finished compaction run and adds it to StorageStats.
+func recordCompaction(inputs []SsTable, outputs []SsTable, started time.Time) {
+	duration := time.Since(started)
+	var inputBytes, outputBytes int64
+	for _, table := range inputs {
+		inputBytes += table.size
+	}
+	for _, table := range outputs {
+		outputBytes += table.size
+	}
+	log.Printf("Compacted %d ssTables (%d bytes) into %d ssTables (%d bytes) in %s",
+		len(inputs), inputBytes, len(outputs), outputBytes, duration)
+
+	StorageStats.CompactionRuns.Add(1)
+	StorageStats.CompactionInputBytes.Add(inputBytes)
+	StorageStats.CompactionOutputBytes.Add(outputBytes)
+	StorageStats.CompactionMicros.Add(duration.Microseconds())
+	StorageStats.LastCompactionInputBytes.Store(inputBytes)
+	StorageStats.LastCompactionOutputBytes.Store(outputBytes)
+	StorageStats.LastCompactionMicros.Store(duration.Microseconds())
+}
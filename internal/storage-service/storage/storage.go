@@ -2,19 +2,26 @@ package storage
 
 import (
 	"errors"
+	"fmt"
 	"github.com/google/uuid"
-	"io"
-	"io/ioutil"
+	"hash/fnv"
 	"log"
-	"os"
-	"path/filepath"
 	"sync"
-	"time"
 )
 
 type Storage interface {
 	Get(key string, value_channel chan<- string, getFunctionErr_channel chan<- error)
 	Set(key string, value string, getFunctionErr_channel chan<- error)
+	Delete(key string, getFunctionErr_channel chan<- error)
+	Write(batch *WriteBatch, getFunctionErr_channel chan<- error)
+	Scan(start string, end string, limit int, result_channel chan<- []KeyValue, getFunctionErr_channel chan<- error)
+	PrefixScan(prefix string, limit int, result_channel chan<- []KeyValue, getFunctionErr_channel chan<- error)
+	Stats(stats_channel chan<- map[string]int64)
+	PauseCompaction(state_channel chan<- CompactionState)
+	ResumeCompaction(state_channel chan<- CompactionState)
+	TriggerCompaction(wait bool, state_channel chan<- CompactionState)
+	CompactionStatus(state_channel chan<- CompactionState)
+	Snapshot(snapshot_channel chan<- *Snapshot)
 	GC()
 }
 
@@ -24,108 +31,224 @@ type StorageImpl struct {
 	SsTables             *[]SsTable
 	SsTableSegmentLength int64
 	SsTableDir           string
-	JournalPath          string
+	Wal                  *WAL
+	Manifest             *Manifest
 	Merger               Merger
-	MergePeriodSec       int
+	BloomBitsPerKey      int
+	BlockCache           *BlockCache
+	// Compression picks the codec of new ssTables, flushed tables are level 0.
+	Compression Compression
+	Scheduler   *CompactionScheduler
+	// MaxImmutableMemTables is the number of full memtables that may wait for
+	// the background flush before writes block.
+	MaxImmutableMemTables int
+	flusher               flushState
+	keyLocks              [keyLockCount]sync.Mutex
+	// snapshots counts the live snapshots by sequence number.
+	snapshots map[uint64]int
 }
 
+// keyLockCount is the number of locks writes are spread over by key.
+const keyLockCount = 64
+
+// GC compacts ssTables as the Scheduler requests until the process exits.
 func (storage *StorageImpl) GC() {
-	ticker := time.NewTicker(30 * time.Second)
-	for _ = range ticker.C {
-		result := make(chan []SsTable)
-		go storage.Merger.MergeAndCompaction(*storage.SsTables, result)
-		resultSsTables := <-result
-		storage.SsTables = &resultSsTables
-	}
+	storage.Scheduler.Run(storage.compact)
 }
 
-func (storage StorageImpl) Set(key string, value string, getFunctionErr_channel chan<- error) {
+// compact runs the merger over the current ssTables and swaps in its result.
+// The merged tables are removed once the reads in flight release them.
+func (storage *StorageImpl) compact() {
+	storage.Mutex.RLock()
+	ssTables := storage.acquireTables()
+	// Snapshots taken later see the newest version of every merged key.
+	snapshots := storage.liveSnapshots()
+	storage.Mutex.RUnlock()
+	defer releaseTables(ssTables)
+	result := make(chan []SsTable)
+	go storage.Merger.MergeAndCompaction(ssTables, snapshots, result)
+	resultSsTables := <-result
+
 	storage.Mutex.Lock()
 	defer storage.Mutex.Unlock()
-	err := storage.MemTable.Add(key, value)
-	getFunctionErr_channel <- err
-	if err != nil {
-		log.Printf("Copy MemTable to the ssTable")
-		var id = uuid.New()
-		filePath := filepath.Join(storage.SsTableDir, id.String())
-		journalPath := filepath.Join(storage.SsTableDir, "journal")
-		err := os.MkdirAll(journalPath, 0777)
-		if err != nil {
-			log.Printf("error occuring while creating ssTable journal dir. Err: %s", err)
+	// Tables flushed while merging are newer than every merged table.
+	resultSsTables = append(resultSsTables, (*storage.SsTables)[len(ssTables):]...)
+	merged := make(map[uuid.UUID]bool)
+	for _, ssTable := range resultSsTables {
+		merged[ssTable.id] = true
+	}
+	live := make(map[uuid.UUID]bool)
+	var edit VersionEdit
+	for _, ssTable := range *storage.SsTables {
+		live[ssTable.id] = true
+		if !merged[ssTable.id] {
+			edit.Removed = append(edit.Removed, ssTable.id)
 		}
-		var newTable = SsTable{dPath: filePath + ".bin", jPath: filepath.Join(journalPath, id.String()) + ".bin", segLen: storage.SsTableSegmentLength, ind: make(map[string]SparseIndices),
-			id: uuid.New()}
-		newTable.Init(storage.MemTable)
-		storage.MemTable.Clear()
-		filenames := GetFileNamesInDir(storage.JournalPath)
-		if len(filenames) != 0 {
-			err = os.Remove(filepath.Join(storage.JournalPath, filenames[0]))
+	}
+	for _, ssTable := range resultSsTables {
+		if !live[ssTable.id] {
+			edit.Added = append(edit.Added, ssTable.meta())
 		}
-		if err != nil {
-			log.Printf("error occuring while deleting journal. Err: %s", err)
+	}
+	if len(edit.Added) == 0 && len(edit.Removed) == 0 {
+		return
+	}
+	// The merged tables are synced by Init, their directory entries are not.
+	err := syncDir(storage.SsTableDir)
+	if err == nil {
+		err = storage.Manifest.LogEdit(edit)
+	}
+	if err != nil {
+		log.Printf("Log compaction in manifest error. Err: %s", err)
+		for i := range resultSsTables {
+			if !live[resultSsTables[i].id] {
+				resultSsTables[i].unref()
+			}
 		}
-		*storage.SsTables = append(*storage.SsTables, newTable)
-	} else {
-		now := time.Now()
-		var timestamp = now.Format("2006-01-02") + "_" + now.Format("15-04-01")
-
-		filePath := filepath.Join(storage.JournalPath, timestamp)
-		file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			log.Printf("Open journal error. Err: %s", err)
+		return
+	}
+	for i := range *storage.SsTables {
+		if !merged[(*storage.SsTables)[i].id] {
+			(*storage.SsTables)[i].unref()
 		}
-		defer func() {
-			if err = file.Close(); err != nil {
-				log.Printf("Close journal error. Err: %s", err)
+	}
+	storage.SsTables = &resultSsTables
+}
+
+func (storage *StorageImpl) Set(key string, value string, getFunctionErr_channel chan<- error) {
+	getFunctionErr_channel <- storage.write([]KeyValue{{Key: key, Value: value}})
+}
+
+func (storage *StorageImpl) Delete(key string, getFunctionErr_channel chan<- error) {
+	getFunctionErr_channel <- storage.write([]KeyValue{{Key: key, Deleted: true}})
+}
+
+// ErrNotSynced reports writes that are applied but whose journal record could
+// not be synced. Their outcome is unknown: readers see them and they are
+// flushed with the MemTable, yet a crash before the record reaches the disk
+// loses them.
+var ErrNotSynced = errors.New("write is applied but its journal record was not synced")
+
+// write applies the writes and acknowledges them once their journal record is
+// as durable as the WAL sync policy asks. The sync runs outside the lock so
+// that concurrent writers share it. A failed journal append writes nothing, a
+// failed sync is ErrNotSynced.
+func (storage *StorageImpl) write(writes []KeyValue) error {
+	seq, err := storage.apply(writes)
+	if err != nil {
+		return err
+	}
+	if err = storage.Wal.Sync(seq); err != nil {
+		log.Printf("Sync journal error. Err: %s", err)
+		return fmt.Errorf("%w: %s", ErrNotSynced, err)
+	}
+	return nil
+}
+
+// apply logs the writes as one journal record and stores them under its
+// sequence number. Writers share the read lock, the MemTable takes concurrent
+// writes and the key locks keep the journal order and the MemTable order of
+// writes to one key the same. The write lock is only taken to wait for
+// flushes and to freeze a full MemTable, so no journal append is in flight
+// when a journal generation ends and a snapshot sees a whole batch or none of
+// it. The keys of writes are distinct.
+func (storage *StorageImpl) apply(writes []KeyValue) (uint64, error) {
+	storage.Mutex.RLock()
+	for storage.flushPending() {
+		storage.Mutex.RUnlock()
+		storage.Mutex.Lock()
+		storage.waitForFlush()
+		storage.Mutex.Unlock()
+		storage.Mutex.RLock()
+	}
+	memTable := storage.MemTable
+	unlockKeys := storage.lockKeys(writes)
+	seq, err := storage.Wal.Append(writes)
+	if err != nil {
+		unlockKeys()
+		storage.Mutex.RUnlock()
+		log.Printf("Write in journal error. Err: %s", err)
+		return 0, err
+	}
+	full := false
+	for _, write := range writes {
+		if write.Deleted {
+			err = memTable.Delete(write.Key, seq)
+		} else {
+			err = memTable.Add(write.Key, write.Value, seq)
+		}
+		full = full || errors.Is(err, ErrMemTableFull)
+	}
+	unlockKeys()
+	storage.Mutex.RUnlock()
+
+	if full {
+		storage.Mutex.Lock()
+		// Another writer may have frozen it already.
+		if storage.MemTable == memTable {
+			// The writes are stored either way, a failed freeze is retried on
+			// the next write.
+			if err = storage.freeze(); err != nil {
+				log.Printf("Freeze MemTable error. Err: %s", err)
 			}
-		}()
-		_, err = file.WriteString("Add key-value pair: " + key + ":" + value + ". Time: " + time.Now().String() + "\n")
-		if err != nil {
-			log.Printf("Write in journal error. Err: %s", err)
 		}
+		storage.Mutex.Unlock()
 	}
-	getFunctionErr_channel <- nil
-	return
+	return seq, nil
 }
 
-func (storage StorageImpl) Get(key string, value_channel chan<- string, getFunctionErr_channel chan<- error) {
+func keyLockIndex(key string) uint32 {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return hash.Sum32() % keyLockCount
+}
+
+func (storage *StorageImpl) Get(key string, value_channel chan<- string, getFunctionErr_channel chan<- error) {
+	storage.get(key, MaxSeq, value_channel, getFunctionErr_channel)
+}
+
+// get reads the newest version of the key with a sequence number not above seq.
+func (storage *StorageImpl) get(key string, seq uint64, value_channel chan<- string, getFunctionErr_channel chan<- error) {
 	storage.Mutex.RLock()
 	defer storage.Mutex.RUnlock()
-	var val, err = storage.MemTable.Find(key)
+	var val, err = storage.MemTable.Find(key, seq)
 	if err == nil {
 		value_channel <- val
 		getFunctionErr_channel <- err
 		return
 	}
+	for i := len(storage.flusher.immutables) - 1; i >= 0 && errors.Is(err, ErrKeyNotFound); i-- {
+		val, err = storage.flusher.immutables[i].memTable.Find(key, seq)
+	}
+	if err == nil {
+		value_channel <- val
+		getFunctionErr_channel <- err
+		return
+	}
+	if errors.Is(err, ErrKeyDeleted) {
+		value_channel <- ""
+		getFunctionErr_channel <- ErrKeyNotFound
+		return
+	}
 	for i := len(*storage.SsTables) - 1; i >= 0; i-- {
 		ssTable := (*storage.SsTables)[i]
-		val, err = ssTable.Find(key)
-		if val != "" {
+		val, err = ssTable.Find(key, seq)
+		if err == nil {
 			value_channel <- val
 			getFunctionErr_channel <- err
 			return
 		}
-	}
-	err = errors.New("key was not found")
-	getFunctionErr_channel <- err
-	return
-}
-
-func GetFileNamesInDir(name string) []string {
-	f, err := os.Open(name)
-	if err != nil {
-		log.Printf("Open journal dir error. Err: %s", err)
-		return make([]string, 0)
-	}
-	defer func() {
-		if err = f.Close(); err != nil {
-			log.Printf("Close journal dir error. Err: %s", err)
+		if errors.Is(err, ErrKeyDeleted) {
+			break
+		}
+		if !errors.Is(err, ErrKeyNotFound) {
+			// A table that cannot be read may hold the newest value.
+			value_channel <- ""
+			getFunctionErr_channel <- err
+			return
 		}
-	}()
-	files, _ := ioutil.ReadDir(name)
-	fileNames, err := f.Readdirnames(len(files))
-	if err == io.EOF {
-		return make([]string, 0)
 	}
-	return fileNames
+	value_channel <- ""
+	getFunctionErr_channel <- ErrKeyNotFound
+	return
 }
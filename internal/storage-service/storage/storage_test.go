@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestStorage returns a storage in a new directory with a MemTable of
+// memTableSize bytes and ssTable segments of segLen bytes. Its journal syncs
+// every write and its tables are compacted by the merge strategy.
+func newTestStorage(t *testing.T, memTableSize uintptr, segLen int64) *StorageImpl {
+	t.Helper()
+	dir := t.TempDir()
+	journalDir := filepath.Join(dir, "WAL")
+	wal, _, err := OpenWAL(journalDir, SyncPolicy{Mode: SyncAlways}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := CreateManifest(dir, Version{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := &StorageImpl{
+		MemTable:             NewSkipListMemTable(memTableSize),
+		SsTableSegmentLength: segLen,
+		SsTableDir:           dir,
+		SsTables:             new([]SsTable),
+		Wal:                  wal,
+		Manifest:             manifest,
+		Merger:               &MergerImpl{MemNewFileLimit: memTableSize, StorageSstDirPath: dir, SsTableSegmentLength: segLen, BloomBitsPerKey: 10},
+		BloomBitsPerKey:      10,
+	}
+	t.Cleanup(func() {
+		// The background flush must not write into the removed directory.
+		waitFlushed(storage)
+		wal.Close()
+		manifest.Close()
+	})
+	return storage
+}
+
+// waitFlushed waits until every immutable MemTable is written to an ssTable.
+func waitFlushed(storage *StorageImpl) {
+	for {
+		storage.Mutex.RLock()
+		pending := len(storage.flusher.immutables)
+		storage.Mutex.RUnlock()
+		if pending == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// testFlush writes the MemTable of the storage to an ssTable.
+func testFlush(t *testing.T, storage *StorageImpl) {
+	t.Helper()
+	storage.Mutex.Lock()
+	err := storage.freeze()
+	storage.Mutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFlushed(storage)
+}
+
+func testSet(storage Storage, key string, value string) error {
+	errChan := make(chan error, 1)
+	storage.Set(key, value, errChan)
+	return <-errChan
+}
+
+func testDelete(storage Storage, key string) error {
+	errChan := make(chan error, 1)
+	storage.Delete(key, errChan)
+	return <-errChan
+}
+
+func testWrite(storage Storage, batch *WriteBatch) error {
+	errChan := make(chan error, 1)
+	storage.Write(batch, errChan)
+	return <-errChan
+}
+
+func testGet(storage Storage, key string) (string, error) {
+	valueChan, errChan := make(chan string, 1), make(chan error, 1)
+	storage.Get(key, valueChan, errChan)
+	return <-valueChan, <-errChan
+}
+
+func testScan(storage Storage, start string, end string, limit int) ([]KeyValue, error) {
+	resultChan, errChan := make(chan []KeyValue, 1), make(chan error, 1)
+	storage.Scan(start, end, limit, resultChan, errChan)
+	return <-resultChan, <-errChan
+}
+
+// A failed journal append writes nothing. A failed sync is ErrNotSynced and
+// the writes are applied, so their outcome is unknown to the caller.
+func TestWriteWithFailedJournal(t *testing.T) {
+	failures := []struct {
+		name string
+		// fail breaks the journal of the storage and returns the function
+		// repairing it.
+		fail      func(t *testing.T, wal *WAL) func()
+		notSynced bool
+	}{
+		{"append fails", func(t *testing.T, wal *WAL) func() {
+			wal.file.Close()
+			return func() {}
+		}, false},
+		{"sync fails", func(t *testing.T, wal *WAL) func() {
+			// Writes to /dev/null succeed, syncing it fails.
+			devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wal.mutex.Lock()
+			file := wal.file
+			wal.file = devNull
+			wal.mutex.Unlock()
+			return func() {
+				wal.mutex.Lock()
+				wal.file = file
+				wal.mutex.Unlock()
+				devNull.Close()
+			}
+		}, true},
+	}
+	writes := []struct {
+		name  string
+		write func(storage Storage) error
+		// value is the value of the key once the write is applied.
+		value string
+	}{
+		{"set", func(storage Storage) error { return testSet(storage, "key", "new") }, "new"},
+		{"delete", func(storage Storage) error { return testDelete(storage, "key") }, ""},
+		{"batch", func(storage Storage) error {
+			batch := &WriteBatch{}
+			batch.Set("key", "new")
+			batch.Set("other", "new")
+			return testWrite(storage, batch)
+		}, "new"},
+	}
+	for _, failure := range failures {
+		for _, write := range writes {
+			t.Run(failure.name+"/"+write.name, func(t *testing.T) {
+				storage := newTestStorage(t, 1<<20, 1000)
+				if err := testSet(storage, "key", "old"); err != nil {
+					t.Fatal(err)
+				}
+				repair := failure.fail(t, storage.Wal)
+				err := write.write(storage)
+				repair()
+				if err == nil || errors.Is(err, ErrNotSynced) != failure.notSynced {
+					t.Fatalf("write error is %v, want not synced %v", err, failure.notSynced)
+				}
+
+				want := "old"
+				if failure.notSynced {
+					want = write.value
+				}
+				if value, _ := testGet(storage, "key"); value != want {
+					t.Fatalf("key is %q after the failed write, want %q", value, want)
+				}
+				if err = testSet(storage, "after", "value"); err != nil {
+					t.Fatalf("write after the repair failed: %s", err)
+				}
+			})
+		}
+	}
+}
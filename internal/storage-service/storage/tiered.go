@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"log"
+	"time"
+)
+
+// SizeTieredMerger groups ssTables of similar size into buckets and merges a
+// bucket into a single table once it holds MinThreshold tables. Every key is
+// rewritten roughly once per tier, trading read amplification for lower write
+// amplification.
+//
+// Tables are read newest value first by their position in the ssTables slice,
+// so a bucket is a run of adjacent tables. A table belongs to the run when its
+// size lies within BucketLow and BucketHigh times the average size of the run.
+// Tables smaller than MinTableSize are all considered similar.
+type SizeTieredMerger struct {
+	MergerImpl
+	MinThreshold int
+	MaxThreshold int
+	BucketLow    float64
+	BucketHigh   float64
+	MinTableSize int64
+}
+
+func (merger *SizeTieredMerger) MergeAndCompaction(ssTables []SsTable, snapshots []uint64, newSsTables chan<- []SsTable) {
+	merger.Mutex.Lock()
+	defer merger.Mutex.Unlock()
+	start, end := merger.pickBucket(ssTables)
+	if end-start < 2 {
+		newSsTables <- ssTables
+		return
+	}
+	log.Printf("Compact %d ssTables of a size tier", end-start)
+	started := time.Now()
+	// Tombstones may only go when no older table can hold the deleted keys.
+	outputs, err := merger.merge(ssTables[start:end], snapshots, start == 0, 0, 0)
+	if err != nil {
+		log.Printf("Merge ssTables error. Err: %s", err)
+		newSsTables <- ssTables
+		return
+	}
+	recordCompaction(ssTables[start:end], outputs, started)
+
+	result := make([]SsTable, 0, len(ssTables)-(end-start)+len(outputs))
+	result = append(result, ssTables[:start]...)
+	result = append(result, outputs...)
+	result = append(result, ssTables[end:]...)
+	newSsTables <- result
+}
+
+// pickBucket returns the bounds of the bucket to compact. Among the buckets
+// holding at least MinThreshold tables the one with the smallest tables wins.
+// An empty range means nothing needs compacting.
+func (merger *SizeTieredMerger) pickBucket(ssTables []SsTable) (int, int) {
+	bestStart, bestEnd := 0, 0
+	var bestAverage float64
+	for start := 0; start < len(ssTables); {
+		end := start + 1
+		total := merger.tableSize(ssTables[start])
+		for end < len(ssTables) {
+			average := float64(total) / float64(end-start)
+			size := float64(merger.tableSize(ssTables[end]))
+			if size < average*merger.BucketLow || size > average*merger.BucketHigh {
+				break
+			}
+			total += merger.tableSize(ssTables[end])
+			end++
+		}
+		average := float64(total) / float64(end-start)
+		if end-start >= merger.MinThreshold && (bestEnd == bestStart || average < bestAverage) {
+			bestStart, bestEnd, bestAverage = start, end, average
+		}
+		start = end
+	}
+	if merger.MaxThreshold > 0 && bestEnd-bestStart > merger.MaxThreshold {
+		bestEnd = bestStart + merger.MaxThreshold
+	}
+	return bestStart, bestEnd
+}
+
+func (merger *SizeTieredMerger) tableSize(table SsTable) int64 {
+	if table.size < merger.MinTableSize {
+		return merger.MinTableSize
+	}
+	return table.size
+}
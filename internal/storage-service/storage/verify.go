@@ -0,0 +1,263 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// VerifyReport is the result of checking a data directory with Verify. Errors
+// are damage that loses or hides data, warnings are leftovers a restart cleans
+// up or the torn tail a crash leaves in the newest WAL segment.
+type VerifyReport struct {
+	SsTableDir string          `json:"sstable_dir"`
+	JournalDir string          `json:"journal_dir"`
+	OK         bool            `json:"ok"`
+	Errors     int             `json:"errors"`
+	Warnings   int             `json:"warnings"`
+	Manifest   ManifestReport  `json:"manifest"`
+	Tables     []TableReport   `json:"tables"`
+	Wal        []WalFileReport `json:"wal"`
+}
+
+type ManifestReport struct {
+	Found      bool     `json:"found"`
+	Tables     int      `json:"tables"`
+	FlushedSeq uint64   `json:"flushed_seq"`
+	Errors     []string `json:"errors,omitempty"`
+	Warnings   []string `json:"warnings,omitempty"`
+}
+
+type TableReport struct {
+	ID          string   `json:"id"`
+	Path        string   `json:"path"`
+	Live        bool     `json:"live"`
+	Level       int      `json:"level"`
+	Checksummed bool     `json:"checksummed"`
+	Segments    int      `json:"segments"`
+	Keys        int      `json:"keys"`
+	Tombstones  int      `json:"tombstones"`
+	FirstKey    string   `json:"first_key"`
+	LastKey     string   `json:"last_key"`
+	Errors      []string `json:"errors,omitempty"`
+	Warnings    []string `json:"warnings,omitempty"`
+}
+
+type WalFileReport struct {
+	Name       string   `json:"name"`
+	Legacy     bool     `json:"legacy,omitempty"`
+	Generation uint64   `json:"generation"`
+	Records    int      `json:"records"`
+	FirstSeq   uint64   `json:"first_seq"`
+	LastSeq    uint64   `json:"last_seq"`
+	Errors     []string `json:"errors,omitempty"`
+	Warnings   []string `json:"warnings,omitempty"`
+}
+
+// Verify checks the ssTables and the WAL of a data directory without
+// modifying it. Every segment of every table is read, checked against its
+// checksum and decompressed; keys must be sorted and unique within a table and
+// the index must describe the segments as they are laid out in the file.
+// Tables are checked against the manifest when there is one.
+func Verify(ssTableDir string, journalDir string) VerifyReport {
+	report := VerifyReport{SsTableDir: ssTableDir, JournalDir: journalDir, Tables: make([]TableReport, 0), Wal: make([]WalFileReport, 0)}
+
+	version, found, err := RecoverManifest(ssTableDir)
+	report.Manifest.Found = found
+	if err != nil {
+		report.Manifest.Errors = append(report.Manifest.Errors, err.Error())
+	}
+	if !found && err == nil {
+		report.Manifest.Warnings = append(report.Manifest.Warnings, "no manifest, every table is taken as live")
+	}
+	report.Manifest.Tables, report.Manifest.FlushedSeq = len(version.Tables), version.FlushedSeq
+	live := make(map[uuid.UUID]TableMeta, len(version.Tables))
+	for _, meta := range version.Tables {
+		live[meta.ID] = meta
+	}
+
+	entries, err := os.ReadDir(ssTableDir)
+	if err != nil {
+		report.Manifest.Errors = append(report.Manifest.Errors, err.Error())
+	}
+	onDisk := make(map[uuid.UUID]bool)
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".gz" {
+			continue
+		}
+		id, err := uuid.Parse(strings.TrimSuffix(entry.Name(), ".gz"))
+		if err != nil {
+			continue
+		}
+		onDisk[id] = true
+		meta, isLive := live[id]
+		tableReport := verifyTable(ssTableDir, id)
+		tableReport.Live, tableReport.Level = isLive || !found, meta.Level
+		if found && !isLive {
+			tableReport.Warnings = append(tableReport.Warnings, "table is not in the manifest")
+		}
+		report.Tables = append(report.Tables, tableReport)
+	}
+	for _, meta := range version.Tables {
+		if !onDisk[meta.ID] {
+			report.Manifest.Errors = append(report.Manifest.Errors, fmt.Sprintf("live table %s is missing", meta.ID))
+		}
+	}
+
+	report.Wal = verifyWal(journalDir)
+
+	report.count(report.Manifest.Errors, report.Manifest.Warnings)
+	for _, table := range report.Tables {
+		report.count(table.Errors, table.Warnings)
+	}
+	for _, file := range report.Wal {
+		report.count(file.Errors, file.Warnings)
+	}
+	report.OK = report.Errors == 0
+	return report
+}
+
+func (report *VerifyReport) count(errors []string, warnings []string) {
+	report.Errors += len(errors)
+	report.Warnings += len(warnings)
+}
+
+func verifyTable(dir string, id uuid.UUID) TableReport {
+	path := filepath.Join(dir, id.String()+".gz")
+	report := TableReport{ID: id.String(), Path: path}
+	fail := func(format string, args ...any) {
+		report.Errors = append(report.Errors, fmt.Sprintf(format, args...))
+	}
+	file, err := openTableFile(path, filepath.Join(dir, "journal", id.String()+".bin"))
+	if err != nil {
+		fail("open table: %s", err)
+		return report
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fail("read table: %s", err)
+		return report
+	}
+	report.Checksummed, report.Segments = file.textChunks == nil, len(file.ind)
+
+	bloom, err := LoadBloomFilter(filepath.Join(dir, id.String()+".bloom"))
+	if err != nil && !os.IsNotExist(err) {
+		fail("read bloom filter: %s", err)
+	}
+
+	var previous string
+	var previousSeq uint64
+	offset := int64(0)
+	for i, entry := range file.ind {
+		if entry.start != offset {
+			fail("segment %d starts at %d, the previous one ends at %d", i, entry.start, offset)
+		}
+		offset = entry.end
+		if entry.end <= entry.start || entry.end > file.segmentsEnd {
+			fail("segment %d has bounds [%d, %d) outside the segments", i, entry.start, entry.end)
+			continue
+		}
+		keyValues, _, err := file.decodeSegment(entry, data[entry.start:entry.end])
+		if err != nil {
+			fail("segment %d: %s", i, err)
+			continue
+		}
+		if len(keyValues) == 0 {
+			fail("segment %d at offset %d is empty", i, entry.start)
+			continue
+		}
+		if keyValues[0].Key != entry.key {
+			fail("segment %d at offset %d starts with %q, the index says %q", i, entry.start, keyValues[0].Key, entry.key)
+		}
+		if last := keyValues[len(keyValues)-1].Key; file.layout == footerTableFormat && last != entry.lastKey {
+			fail("segment %d at offset %d ends with %q, the index says %q", i, entry.start, last, entry.lastKey)
+		}
+		if report.Keys != 0 && keyValues[0].Key == previous {
+			fail("segment %d at offset %d: versions of key %q are split between segments", i, entry.start, previous)
+		}
+		for j, keyValue := range keyValues {
+			// The versions of a key follow each other newest first.
+			olderVersion := j != 0 && keyValue.Key == previous && keyValue.Seq < previousSeq
+			if report.Keys != 0 && keyValue.Key <= previous && !olderVersion {
+				fail("segment %d at offset %d: key %q follows %q", i, entry.start, keyValue.Key, previous)
+			}
+			if bloom != nil && !bloom.MayContain(keyValue.Key) {
+				fail("bloom filter misses key %q", keyValue.Key)
+			}
+			if report.Keys == 0 {
+				report.FirstKey = keyValue.Key
+			}
+			if keyValue.Deleted {
+				report.Tombstones++
+			}
+			previous, previousSeq = keyValue.Key, keyValue.Seq
+			report.Keys++
+		}
+		report.LastKey = previous
+	}
+	if offset != file.segmentsEnd && len(file.ind) != 0 {
+		fail("segments end at %d, the index block starts at %d", offset, file.segmentsEnd)
+	}
+	return report
+}
+
+// verifyWal parses every WAL segment and legacy journal of dir in replay order.
+func verifyWal(dir string) []WalFileReport {
+	reports := make([]WalFileReport, 0)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			reports = append(reports, WalFileReport{Name: dir, Errors: []string{err.Error()}})
+		}
+		return reports
+	}
+	segments := make([]uint64, 0)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if segment, ok := parseSegmentName(entry.Name()); ok {
+			segments = append(segments, segment)
+			continue
+		}
+		report := WalFileReport{Name: entry.Name(), Legacy: true}
+		if keyValues, ok := readLegacyJournal(filepath.Join(dir, entry.Name())); ok {
+			report.Records = len(keyValues)
+		} else {
+			report.Legacy = false
+			report.Warnings = append(report.Warnings, "not a WAL segment or journal")
+		}
+		reports = append(reports, report)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+
+	var lastSeq uint64
+	for _, segment := range segments {
+		name := segmentName(segment)
+		generation, records, err := readWalSegment(filepath.Join(dir, name))
+		report := WalFileReport{Name: name, Generation: generation, Records: len(records)}
+		if len(records) != 0 {
+			report.FirstSeq, report.LastSeq = records[0].Seq, records[len(records)-1].Seq
+		}
+		for _, record := range records {
+			if record.Seq <= lastSeq {
+				report.Errors = append(report.Errors, fmt.Sprintf("sequence number %d follows %d", record.Seq, lastSeq))
+			}
+			lastSeq = record.Seq
+		}
+		switch {
+		case err == nil:
+		case errors.Is(err, errTornTail):
+			// A crash may tear the last record of a segment.
+			report.Warnings = append(report.Warnings, err.Error())
+		default:
+			report.Errors = append(report.Errors, err.Error())
+		}
+		reports = append(reports, report)
+	}
+	return reports
+}
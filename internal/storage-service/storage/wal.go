@@ -0,0 +1,653 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WAL segments are named by their number and start with walMagic followed by
+// the MemTable generation (8) whose writes they hold. Every record is framed as
+//
+//	payload length (4) | CRC32-C of payload (4) | payload
+//
+// and the payload is the sequence number (8) followed by a put or delete record
+// as stored in ssTables, or by recordBatch, the entry count and the records of
+// the batch. A batch shares one sequence number.
+const (
+	walSegmentExt   = ".wal"
+	walHeaderSize   = 14
+	walFrameHeader  = 8
+	recordBatch     = 3
+	walMaxRecordLen = 1 << 30
+)
+
+var (
+	walMagic = []byte("PHWAL\x02")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// SyncMode tells when appended records are synced to disk.
+type SyncMode string
+
+const (
+	// SyncNone leaves syncing to the operating system.
+	SyncNone SyncMode = "none"
+	// SyncAlways syncs before a write is acknowledged. Concurrent writers
+	// share one fsync.
+	SyncAlways SyncMode = "always"
+	// SyncInterval syncs every SyncPolicy.Interval in the background.
+	SyncInterval SyncMode = "interval"
+	// SyncBytes syncs once SyncPolicy.Bytes have been written since the last
+	// sync.
+	SyncBytes SyncMode = "bytes"
+)
+
+// SyncPolicy is the durability level of acknowledged writes. Only SyncAlways
+// guarantees that an acknowledged write survives a machine crash, the other
+// modes bound the amount of data that may be lost.
+type SyncPolicy struct {
+	Mode     SyncMode
+	Interval time.Duration
+	Bytes    int64
+}
+
+// WalRecord is one logged write. Put and delete records hold one entry.
+type WalRecord struct {
+	Seq     uint64
+	Entries []KeyValue
+}
+
+// WalGeneration is an ended MemTable generation and the sequence numbers of
+// its records. FirstSeq is LastSeq+1 for a generation without records.
+type WalGeneration struct {
+	Number   uint64
+	FirstSeq uint64
+	LastSeq  uint64
+}
+
+// WAL appends records to the current segment of the journal directory. Replayed
+// segments are never appended to: opening a WAL starts a new segment.
+//
+// Every segment belongs to a MemTable generation. A segment that grows past
+// segmentSize is followed by a new one of the same generation, and
+// NewGeneration starts the segments of the next MemTable. The segments of a
+// generation are removed once its ssTable is durable.
+//
+// Records are written as they are appended and synced as the SyncPolicy asks.
+// Syncs use group commit: a writer waiting for its record to be synced either
+// runs an fsync covering every record written so far or waits for the one in
+// progress, so concurrent writers share fsync calls.
+type WAL struct {
+	mutex   sync.Mutex
+	synced  *sync.Cond
+	dir     string
+	file    *os.File
+	segment uint64
+	// generation is the MemTable generation of the current segment and
+	// firstSeq the first sequence number it may hold.
+	generation  uint64
+	firstSeq    uint64
+	segmentSize int64
+	segmentLen  int64
+	nextSeq     uint64
+	policy      SyncPolicy
+	syncing     bool
+	// syncedSeq is the last record known to be on disk.
+	syncedSeq    uint64
+	writtenBytes int64
+	syncedBytes  int64
+	stop         chan struct{}
+	// failed is set when a partly written record could be neither removed
+	// nor left behind in a closed segment. Every append retries the
+	// rotation and fails until it succeeds.
+	failed error
+	// legacy holds journals written before the binary WAL.
+	legacy []string
+}
+
+// OpenWAL replays every segment of dir in sequence order and opens a new
+// segment for appending. Files that are neither segments nor legacy journals
+// are skipped. Replay of a segment stops at a torn last record, any other
+// damaged record fails the open with ErrCorruption.
+//
+// The replayed records go to a single MemTable, so the new segment continues
+// the latest replayed generation and flushing that MemTable releases every
+// replayed segment.
+func OpenWAL(dir string, policy SyncPolicy, segmentSize int64) (*WAL, []WalRecord, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	wal := &WAL{dir: dir, nextSeq: 1, generation: 1, segmentSize: segmentSize, policy: policy, stop: make(chan struct{})}
+	wal.synced = sync.NewCond(&wal.mutex)
+	records := make([]WalRecord, 0)
+	segments := make([]uint64, 0)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if segment, ok := parseSegmentName(entry.Name()); ok {
+			segments = append(segments, segment)
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		keyValues, ok := readLegacyJournal(path)
+		if !ok {
+			log.Printf("Skip unknown file %s in WAL directory", entry.Name())
+			continue
+		}
+		log.Printf("Replaying legacy journal %s", entry.Name())
+		for _, keyValue := range keyValues {
+			records = append(records, WalRecord{Seq: wal.nextSeq, Entries: []KeyValue{keyValue}})
+			wal.nextSeq++
+		}
+		wal.legacy = append(wal.legacy, path)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+
+	for _, segment := range segments {
+		generation, segmentRecords, err := readWalSegment(wal.segmentPath(segment))
+		if errors.Is(err, errTornTail) {
+			log.Printf("Replay WAL segment %d stopped. Err: %s", segment, err)
+		} else if err != nil {
+			// Acknowledged records after the damage would be lost.
+			return nil, nil, err
+		}
+		if generation > wal.generation {
+			wal.generation = generation
+		}
+		for _, record := range segmentRecords {
+			if record.Seq >= wal.nextSeq {
+				wal.nextSeq = record.Seq + 1
+			}
+		}
+		records = append(records, segmentRecords...)
+		wal.segment = segment
+	}
+	if err = wal.openSegment(wal.segment + 1); err != nil {
+		return nil, nil, err
+	}
+	wal.syncedSeq = wal.nextSeq - 1
+	wal.firstSeq = wal.nextSeq
+	if len(records) != 0 {
+		wal.firstSeq = records[0].Seq
+	}
+	if policy.Mode == SyncInterval && policy.Interval > 0 {
+		go wal.syncPeriodically()
+	}
+	return wal, records, nil
+}
+
+func parseSegmentName(name string) (uint64, bool) {
+	if filepath.Ext(name) != walSegmentExt {
+		return 0, false
+	}
+	var segment uint64
+	if _, err := fmt.Sscanf(strings.TrimSuffix(name, walSegmentExt), "%d", &segment); err != nil {
+		return 0, false
+	}
+	return segment, fmt.Sprintf("%020d%s", segment, walSegmentExt) == name
+}
+
+func (wal *WAL) segmentPath(segment uint64) string {
+	return filepath.Join(wal.dir, segmentName(segment))
+}
+
+func segmentName(segment uint64) string {
+	return fmt.Sprintf("%020d%s", segment, walSegmentExt)
+}
+
+func (wal *WAL) openSegment(segment uint64) error {
+	file, err := wal.createSegment(segment, wal.generation)
+	if err != nil {
+		return err
+	}
+	wal.file, wal.segment, wal.segmentLen = file, segment, walHeaderSize
+	return nil
+}
+
+// createSegment creates the segment with the header of the generation.
+func (wal *WAL) createSegment(segment uint64, generation uint64) (*os.File, error) {
+	file, err := os.OpenFile(wal.segmentPath(segment), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	header := binary.LittleEndian.AppendUint64(append([]byte{}, walMagic...), generation)
+	if _, err = file.Write(header); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if wal.policy.Mode != SyncNone {
+		// Make the new segment itself durable.
+		if err = syncDir(wal.dir); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return file, nil
+}
+
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// Append logs the entries as one record and returns its sequence number. More
+// than one entry is logged as a batch.
+func (wal *WAL) Append(entries []KeyValue) (uint64, error) {
+	wal.mutex.Lock()
+	defer wal.mutex.Unlock()
+	seq := wal.nextSeq
+	payload := binary.LittleEndian.AppendUint64(nil, seq)
+	if len(entries) == 1 {
+		payload = AppendRecord(payload, entries[0].Key, entries[0].Value, entries[0].Deleted)
+	} else {
+		payload = append(payload, recordBatch)
+		payload = binary.AppendUvarint(payload, uint64(len(entries)))
+		for _, entry := range entries {
+			payload = AppendRecord(payload, entry.Key, entry.Value, entry.Deleted)
+		}
+	}
+	if wal.failed != nil {
+		wal.waitForSync()
+		if err := wal.rotate(wal.generation); err != nil {
+			return 0, fmt.Errorf("%s, retry failed: %s", wal.failed, err)
+		}
+	}
+	n, err := wal.file.Write(appendFrame(nil, payload))
+	if err != nil {
+		// A short write leaves a torn record behind.
+		wal.discardPartialWrite()
+		return 0, err
+	}
+	wal.writtenBytes += int64(n)
+	wal.segmentLen += int64(n)
+	wal.nextSeq++
+	if wal.segmentSize > 0 && wal.segmentLen >= wal.segmentSize {
+		wal.waitForSync()
+		// Another writer may have rotated while this one waited.
+		if wal.segmentLen >= wal.segmentSize {
+			if err = wal.rotate(wal.generation); err != nil {
+				log.Printf("Rotate journal error. Err: %s", err)
+			}
+		}
+	}
+	return seq, nil
+}
+
+// discardPartialWrite cuts the current segment back to its last complete
+// record after a failed write, so that replay does not stop at a torn record
+// and drop the records appended after it. A segment that cannot be cut back is
+// replaced by a new one, and when that fails too the WAL refuses appends until
+// a rotation succeeds. The caller holds the mutex.
+func (wal *WAL) discardPartialWrite() {
+	err := wal.file.Truncate(wal.segmentLen)
+	if err == nil {
+		_, err = wal.file.Seek(wal.segmentLen, io.SeekStart)
+	}
+	if err == nil {
+		return
+	}
+	log.Printf("Truncate WAL segment %d error. Err: %s", wal.segment, err)
+	wal.waitForSync()
+	if err = wal.rotate(wal.generation); err != nil {
+		wal.failed = fmt.Errorf("WAL segment %d holds a partly written record and no new segment could be started: %s", wal.segment, err)
+		log.Printf("%s", wal.failed)
+	}
+}
+
+// LastSeq returns the sequence number of the last appended record.
+func (wal *WAL) LastSeq() uint64 {
+	wal.mutex.Lock()
+	defer wal.mutex.Unlock()
+	return wal.nextSeq - 1
+}
+
+// Sync returns once the record with the sequence number is as durable as the
+// SyncPolicy asks.
+func (wal *WAL) Sync(seq uint64) error {
+	switch wal.policy.Mode {
+	case SyncAlways:
+		return wal.syncTo(seq)
+	case SyncBytes:
+		wal.mutex.Lock()
+		unsynced := wal.writtenBytes - wal.syncedBytes
+		wal.mutex.Unlock()
+		if unsynced >= wal.policy.Bytes {
+			return wal.syncTo(seq)
+		}
+	}
+	return nil
+}
+
+// syncTo waits until every record up to seq is on disk, running the fsync
+// itself when no other writer does.
+func (wal *WAL) syncTo(seq uint64) error {
+	wal.mutex.Lock()
+	defer wal.mutex.Unlock()
+	for wal.syncedSeq < seq {
+		if wal.syncing {
+			wal.synced.Wait()
+			continue
+		}
+		wal.syncing = true
+		file, lastSeq, writtenBytes := wal.file, wal.nextSeq-1, wal.writtenBytes
+		wal.mutex.Unlock()
+		err := file.Sync()
+		wal.mutex.Lock()
+		wal.syncing = false
+		wal.synced.Broadcast()
+		if err != nil {
+			return err
+		}
+		wal.syncedSeq, wal.syncedBytes = lastSeq, writtenBytes
+	}
+	return nil
+}
+
+func (wal *WAL) syncPeriodically() {
+	ticker := time.NewTicker(wal.policy.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			wal.mutex.Lock()
+			lastSeq := wal.nextSeq - 1
+			wal.mutex.Unlock()
+			if err := wal.syncTo(lastSeq); err != nil {
+				log.Printf("Sync journal error. Err: %s", err)
+			}
+		case <-wal.stop:
+			return
+		}
+	}
+}
+
+// waitForSync waits until no fsync of the current segment is in progress. It
+// releases the mutex while waiting, so other writers may append meanwhile.
+func (wal *WAL) waitForSync() {
+	for wal.syncing {
+		wal.synced.Wait()
+	}
+}
+
+// closeSegment syncs and closes the current segment. The caller holds the
+// mutex.
+func (wal *WAL) closeSegment() error {
+	wal.waitForSync()
+	err := wal.file.Sync()
+	if err == nil {
+		wal.syncedSeq, wal.syncedBytes = wal.nextSeq-1, wal.writtenBytes
+		wal.synced.Broadcast()
+	}
+	if closeErr := wal.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// rotate starts the next segment, holding records of the given generation,
+// and closes the current one. The current segment stays open until the new one
+// exists, so a failed rotation leaves the WAL appending where it was. The
+// caller holds the mutex and has waited for the sync in progress, so that
+// nothing is appended to the current segment while rotating.
+func (wal *WAL) rotate(generation uint64) error {
+	file, err := wal.createSegment(wal.segment+1, generation)
+	if err != nil {
+		return err
+	}
+	if err = wal.closeSegment(); err != nil {
+		log.Printf("Close WAL segment error. Err: %s", err)
+	}
+	wal.file, wal.segment, wal.segmentLen, wal.generation = file, wal.segment+1, walHeaderSize, generation
+	wal.failed = nil
+	return nil
+}
+
+// NewGeneration starts the segments of the next MemTable generation and
+// returns the generation that ended. On error the current generation goes on.
+func (wal *WAL) NewGeneration() (WalGeneration, error) {
+	wal.mutex.Lock()
+	defer wal.mutex.Unlock()
+	wal.waitForSync()
+	ended := WalGeneration{Number: wal.generation, FirstSeq: wal.firstSeq, LastSeq: wal.nextSeq - 1}
+	if err := wal.rotate(wal.generation + 1); err != nil {
+		return ended, err
+	}
+	wal.firstSeq = wal.nextSeq
+	return ended, nil
+}
+
+// MarkFlushed tells the WAL that every record up to seq is stored in ssTables.
+// Sequence numbers continue after it even when no segment holds them anymore.
+// It is called before the first Append.
+func (wal *WAL) MarkFlushed(seq uint64) {
+	wal.mutex.Lock()
+	defer wal.mutex.Unlock()
+	if seq >= wal.nextSeq {
+		wal.nextSeq = seq + 1
+		wal.syncedSeq = seq
+	}
+	if seq >= wal.firstSeq {
+		wal.firstSeq = seq + 1
+	}
+}
+
+// RemoveGeneration deletes the segments of every generation up to the given
+// one together with the legacy journals. Their records must already be stored
+// in durable ssTables.
+func (wal *WAL) RemoveGeneration(generation uint64) error {
+	wal.mutex.Lock()
+	defer wal.mutex.Unlock()
+	entries, err := os.ReadDir(wal.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		segment, ok := parseSegmentName(entry.Name())
+		if !ok || segment == wal.segment {
+			continue
+		}
+		path := filepath.Join(wal.dir, entry.Name())
+		segmentGeneration, headerErr := readSegmentGeneration(path)
+		if headerErr != nil {
+			log.Printf("Read WAL segment header error. Err: %s", headerErr)
+			continue
+		}
+		if segmentGeneration <= generation {
+			if removeErr := os.Remove(path); removeErr != nil {
+				err = removeErr
+			}
+		}
+	}
+	for _, path := range wal.legacy {
+		if removeErr := os.Remove(path); removeErr != nil && !os.IsNotExist(removeErr) {
+			err = removeErr
+		}
+	}
+	wal.legacy = nil
+	return err
+}
+
+func (wal *WAL) Close() error {
+	close(wal.stop)
+	wal.mutex.Lock()
+	defer wal.mutex.Unlock()
+	return wal.closeSegment()
+}
+
+func readSegmentGeneration(path string) (uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	header := make([]byte, walHeaderSize)
+	if _, err = io.ReadFull(file, header); err != nil {
+		return 0, err
+	}
+	return parseSegmentHeader(header)
+}
+
+func parseSegmentHeader(data []byte) (uint64, error) {
+	if len(data) < walHeaderSize || !bytes.HasPrefix(data, walMagic) {
+		return 0, fmt.Errorf("segment has no WAL header")
+	}
+	return binary.LittleEndian.Uint64(data[len(walMagic):walHeaderSize]), nil
+}
+
+// readWalSegment returns the generation of the segment and its records. A
+// torn last record ends the segment and is reported as errTornTail with the
+// records before it. Damage anywhere else is ErrCorruption.
+func readWalSegment(path string) (uint64, []WalRecord, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	records := make([]WalRecord, 0)
+	if len(data) < walHeaderSize && bytes.HasPrefix(walMagic, data[:min(len(data), len(walMagic))]) {
+		// A crash right after creating the segment.
+		return 0, records, fmt.Errorf("%w: segment header is cut short", errTornTail)
+	}
+	generation, err := parseSegmentHeader(data)
+	if err != nil {
+		return 0, records, fileCorruption(path, 0, err.Error())
+	}
+	err = readFrames(path, data, walHeaderSize, func(payload []byte, offset int) error {
+		record, err := decodeWalRecord(payload)
+		if err != nil {
+			return fileCorruption(path, int64(offset), err.Error())
+		}
+		records = append(records, record)
+		return nil
+	})
+	return generation, records, err
+}
+
+// appendFrame appends the payload framed with its length and checksum.
+func appendFrame(dst []byte, payload []byte) []byte {
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(payload)))
+	dst = binary.LittleEndian.AppendUint32(dst, crc32.Checksum(payload, crcTable))
+	return append(dst, payload...)
+}
+
+// errTornTail reports a record cut short by a crash at the end of a WAL
+// segment or manifest. The record was never acknowledged.
+var errTornTail = errors.New("torn record")
+
+// readFrames calls visit with the payload and offset of every frame of the file
+// data from offset on. Reading stops at the first damaged frame. It is a torn
+// tail, reported as errTornTail, when the frame runs past the end of data,
+// when it is the last frame and fails its checksum, or when only zeroes are
+// left. Any other damaged frame hides the frames after it and is reported as
+// ErrCorruption of the file at path.
+func readFrames(path string, data []byte, offset int, visit func(payload []byte, offset int) error) error {
+	for offset < len(data) {
+		if onlyZeroes(data[offset:]) {
+			return fmt.Errorf("%w at offset %d: zeroes up to the end", errTornTail, offset)
+		}
+		if len(data)-offset < walFrameHeader {
+			return fmt.Errorf("%w at offset %d: header is cut short", errTornTail, offset)
+		}
+		length := binary.LittleEndian.Uint32(data[offset : offset+4])
+		checksum := binary.LittleEndian.Uint32(data[offset+4 : offset+8])
+		if length > walMaxRecordLen {
+			return fileCorruption(path, int64(offset), fmt.Sprintf("record length %d is too large", length))
+		}
+		end := offset + walFrameHeader + int(length)
+		if end > len(data) {
+			return fmt.Errorf("%w at offset %d: record is cut short", errTornTail, offset)
+		}
+		payload := data[offset+walFrameHeader : end]
+		if crc32.Checksum(payload, crcTable) != checksum {
+			if onlyZeroes(data[end:]) {
+				return fmt.Errorf("%w at offset %d: checksum mismatch of the last record", errTornTail, offset)
+			}
+			return fileCorruption(path, int64(offset), "record checksum mismatch")
+		}
+		if err := visit(payload, offset); err != nil {
+			return err
+		}
+		offset = end
+	}
+	return nil
+}
+
+func onlyZeroes(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func decodeWalRecord(payload []byte) (WalRecord, error) {
+	if len(payload) < 9 {
+		return WalRecord{}, errBrokenRecord
+	}
+	record := WalRecord{Seq: binary.LittleEndian.Uint64(payload[0:8])}
+	data := payload[8:]
+	count := uint64(1)
+	if data[0] == recordBatch {
+		var n int
+		count, n = binary.Uvarint(data[1:])
+		if n <= 0 {
+			return WalRecord{}, errBrokenRecord
+		}
+		data = data[1+n:]
+	}
+	for ; count > 0; count-- {
+		keyValue, n, err := DecodeRecord(data)
+		if err != nil {
+			return WalRecord{}, err
+		}
+		if n == 0 {
+			return WalRecord{}, errBrokenRecord
+		}
+		record.Entries = append(record.Entries, keyValue)
+		data = data[n:]
+	}
+	if len(data) != 0 {
+		return WalRecord{}, errBrokenRecord
+	}
+	return record, nil
+}
+
+// readLegacyJournal reads a journal written before the binary WAL. It reports
+// false for any other file.
+func readLegacyJournal(path string) ([]KeyValue, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	firstLine, _ := bufio.NewReader(bytes.NewReader(data)).ReadString('\n')
+	if !strings.HasPrefix(firstLine, "Add key-value pair: ") && !strings.HasPrefix(firstLine, "Delete key: ") {
+		return nil, false
+	}
+	keyValues, err := ReadJournal(path)
+	if err != nil {
+		log.Printf("Read legacy journal error. Err: %s", err)
+	}
+	return keyValues, true
+}
@@ -0,0 +1,220 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openTestWAL(t *testing.T, dir string) (*WAL, []WalRecord) {
+	t.Helper()
+	wal, records, err := OpenWAL(dir, SyncPolicy{Mode: SyncNone}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wal, records
+}
+
+func appendTestRecord(t *testing.T, wal *WAL, entries ...KeyValue) uint64 {
+	t.Helper()
+	seq, err := wal.Append(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return seq
+}
+
+// checkReplay compares the keys of the replayed records and their sequence
+// numbers, which count from 1.
+func checkReplay(t *testing.T, records []WalRecord, keys ...string) {
+	t.Helper()
+	if len(records) != len(keys) {
+		t.Fatalf("replayed %d records %+v, want %d", len(records), records, len(keys))
+	}
+	for i, record := range records {
+		if record.Seq != uint64(i+1) || record.Entries[0].Key != keys[i] {
+			t.Fatalf("record %d is %+v, want key %q with seq %d", i, record, keys[i], i+1)
+		}
+	}
+}
+
+// Replay of a segment stops at its last record when that record is torn or
+// corrupt, and records appended after reopening follow the intact ones.
+func TestWalReplayOfDamagedLastRecord(t *testing.T) {
+	tests := []struct {
+		name string
+		// damage is done at the start of the last record.
+		damage fileDamage
+		want   []string
+	}{
+		{"intact", intact(), []string{"a", "b", "c"}},
+		{"last byte cut", cutEnd(1), []string{"a", "b"}},
+		{"cut inside the record header", cutAt(3), []string{"a", "b"}},
+		{"only the record header written", cutAt(walFrameHeader), []string{"a", "b"}},
+		{"payload bit flipped", flipBits(walFrameHeader+2, 0x01), []string{"a", "b"}},
+		{"checksum bit flipped", flipBits(4, 0x80), []string{"a", "b"}},
+		{"length past the end", addTo(0, 0x10), []string{"a", "b"}},
+		{"last record zeroed", zeroOut(0, 0), []string{"a", "b"}},
+		{"zeroes after the last record", appendZeroes(64), []string{"a", "b", "c"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			wal, _ := openTestWAL(t, dir)
+			appendTestRecord(t, wal, KeyValue{Key: "a", Value: "1"})
+			appendTestRecord(t, wal, KeyValue{Key: "b", Value: "2"}, KeyValue{Key: "x", Deleted: true})
+			lastOffset := int(wal.segmentLen)
+			appendTestRecord(t, wal, KeyValue{Key: "c", Value: "3"})
+			path := wal.segmentPath(wal.segment)
+			if err := wal.Close(); err != nil {
+				t.Fatal(err)
+			}
+			damageFile(t, path, test.damage, lastOffset)
+
+			wal, records := openTestWAL(t, dir)
+			checkReplay(t, records, test.want...)
+			if len(records[1].Entries) != 2 {
+				t.Fatalf("batch replayed as %+v", records[1])
+			}
+			appendTestRecord(t, wal, KeyValue{Key: "d", Value: "4"})
+			if err := wal.Close(); err != nil {
+				t.Fatal(err)
+			}
+			wal, records = openTestWAL(t, dir)
+			defer wal.Close()
+			checkReplay(t, records, append(test.want, "d")...)
+		})
+	}
+}
+
+// A damaged record followed by other records is corruption: the records after
+// it were acknowledged, so the WAL must not open without them.
+func TestWalReplayOfCorruptRecord(t *testing.T) {
+	tests := []struct {
+		name string
+		// damage is done at the start of the middle record.
+		damage fileDamage
+	}{
+		{"payload bit flipped", flipBits(walFrameHeader+2, 0x01)},
+		{"checksum bit flipped", flipBits(5, 0x20)},
+		{"length shortened", addTo(0, -1)},
+		{"length grown", addTo(0, 1)},
+		{"length too large", setTo(3, 0x7f)},
+		{"record zeroed", zeroOut(0, walFrameHeader+2)},
+		{"wrong segment header", func(data []byte, base int) []byte { data[0] = 'X'; return data }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			wal, _ := openTestWAL(t, dir)
+			appendTestRecord(t, wal, KeyValue{Key: "a", Value: "1"})
+			offset := int(wal.segmentLen)
+			appendTestRecord(t, wal, KeyValue{Key: "b", Value: "2"})
+			appendTestRecord(t, wal, KeyValue{Key: "c", Value: "3"})
+			path := wal.segmentPath(wal.segment)
+			if err := wal.Close(); err != nil {
+				t.Fatal(err)
+			}
+			damaged := damageFile(t, path, test.damage, offset)
+
+			wal, records, err := OpenWAL(dir, SyncPolicy{Mode: SyncNone}, 0)
+			var corruption *ErrCorruption
+			if !errors.As(err, &corruption) {
+				if wal != nil {
+					wal.Close()
+				}
+				t.Fatalf("OpenWAL replayed %+v, error %v, want corruption", records, err)
+			}
+			if corruption.Path != path {
+				t.Fatalf("corruption is reported in %s, want %s", corruption.Path, path)
+			}
+			if data, err := os.ReadFile(path); err != nil || !bytes.Equal(data, damaged) {
+				t.Fatalf("failed open changed the segment, err %v", err)
+			}
+		})
+	}
+}
+
+// A failed append must not hide the records appended after it from replay,
+// and the WAL must accept appends again once writing works.
+func TestWalAppendAfterWriteError(t *testing.T) {
+	tests := []struct {
+		name string
+		// fail breaks the WAL so that the next failedAppends appends fail,
+		// repair makes appending work again.
+		fail          func(t *testing.T, wal *WAL)
+		repair        func(wal *WAL)
+		failedAppends int
+	}{
+		{"torn record cut back", func(t *testing.T, wal *WAL) {
+			frame := appendFrame(nil, AppendRecord([]byte{0, 0, 0, 0, 0, 0, 0, 0}, "torn", "value", false))
+			if _, err := wal.file.Write(frame[:len(frame)/2]); err != nil {
+				t.Fatal(err)
+			}
+			wal.discardPartialWrite()
+		}, func(wal *WAL) {}, 0},
+		{"segment file closed", func(t *testing.T, wal *WAL) {
+			wal.file.Close()
+		}, func(wal *WAL) {}, 1},
+		{"no segment can be created", func(t *testing.T, wal *WAL) {
+			wal.file.Close()
+			wal.dir = filepath.Join(wal.dir, "missing")
+		}, func(wal *WAL) {
+			wal.dir = filepath.Dir(wal.dir)
+		}, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			wal, _ := openTestWAL(t, dir)
+			appendTestRecord(t, wal, KeyValue{Key: "a", Value: "1"})
+			test.fail(t, wal)
+			for i := 0; i < test.failedAppends; i++ {
+				if _, err := wal.Append([]KeyValue{{Key: "lost", Value: "x"}}); err == nil {
+					t.Fatalf("append %d after the failure succeeded", i)
+				}
+			}
+			test.repair(wal)
+			if seq := appendTestRecord(t, wal, KeyValue{Key: "b", Value: "2"}); seq != 2 {
+				t.Fatalf("append after the failure got seq %d, want 2", seq)
+			}
+			appendTestRecord(t, wal, KeyValue{Key: "c", Value: "3"})
+			wal.Close()
+
+			wal, records := openTestWAL(t, dir)
+			defer wal.Close()
+			checkReplay(t, records, "a", "b", "c")
+		})
+	}
+}
+
+// A rotation that cannot create the next segment keeps appending to the
+// current one.
+func TestWalFailedRotationKeepsSegment(t *testing.T) {
+	dir := t.TempDir()
+	wal, _ := openTestWAL(t, dir)
+	appendTestRecord(t, wal, KeyValue{Key: "a", Value: "1"})
+	wal.dir = filepath.Join(dir, "missing")
+	if _, err := wal.NewGeneration(); err == nil {
+		t.Fatal("NewGeneration succeeded without a segment")
+	}
+	wal.dir = dir
+	if wal.generation != 1 {
+		t.Fatalf("generation is %d after a failed NewGeneration, want 1", wal.generation)
+	}
+	appendTestRecord(t, wal, KeyValue{Key: "b", Value: "2"})
+	generation, err := wal.NewGeneration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if generation.Number != 1 || generation.FirstSeq != 1 || generation.LastSeq != 2 {
+		t.Fatalf("ended generation is %+v", generation)
+	}
+	wal.Close()
+
+	wal, records := openTestWAL(t, dir)
+	defer wal.Close()
+	checkReplay(t, records, "a", "b")
+}